@@ -2,82 +2,1511 @@ package linode
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/libdns/libdns"
 	"github.com/linode/linodego"
 )
 
-func (p *Provider) init(ctx context.Context) {
-	p.once.Do(func() {
-		p.client = linodego.NewClient(http.DefaultClient)
-		if p.APIToken != "" {
-			p.client.SetToken(p.APIToken)
+const defaultUserAgent = "libdns-linode"
+
+// Client is the part of the linodego client the provider sends its requests
+// through, so that a fake can stand in for the Linode API in tests, see
+// WithClient.
+type Client interface {
+	GetProfile(ctx context.Context) (*linodego.Profile, error)
+	ListDomains(ctx context.Context, opts *linodego.ListOptions) ([]linodego.Domain, error)
+	GetDomain(ctx context.Context, domainID int) (*linodego.Domain, error)
+	CreateDomain(ctx context.Context, opts linodego.DomainCreateOptions) (*linodego.Domain, error)
+	UpdateDomain(ctx context.Context, domainID int, opts linodego.DomainUpdateOptions) (*linodego.Domain, error)
+	ListDomainRecords(ctx context.Context, domainID int, opts *linodego.ListOptions) ([]linodego.DomainRecord, error)
+	GetDomainRecord(ctx context.Context, domainID int, recordID int) (*linodego.DomainRecord, error)
+	CreateDomainRecord(ctx context.Context, domainID int, opts linodego.DomainRecordCreateOptions) (*linodego.DomainRecord, error)
+	UpdateDomainRecord(ctx context.Context, domainID int, recordID int, opts linodego.DomainRecordUpdateOptions) (*linodego.DomainRecord, error)
+	DeleteDomainRecord(ctx context.Context, domainID int, recordID int) error
+}
+
+var _ Client = (*linodego.Client)(nil)
+
+// init configures the Linode client on first use. An error configuring it is
+// returned by every later call as well, until Reconfigure is called. The
+// client keeps no context of its own: every request runs with the context of
+// the call making it, bounded by RequestTimeout.
+func (p *Provider) init() error {
+	p.clientMutex.Lock()
+	defer p.clientMutex.Unlock()
+	if p.client == nil && p.initErr == nil {
+		p.client, p.initErr = p.newClient()
+	}
+	return p.initErr
+}
+
+// apiClient returns the current Linode client. Requests in flight keep the
+// client they started with when Reconfigure replaces it.
+func (p *Provider) apiClient() Client {
+	p.clientMutex.Lock()
+	defer p.clientMutex.Unlock()
+	return p.client
+}
+
+// newClient builds a Linode client from the current configuration, unless a
+// client was given to WithClient.
+func (p *Provider) newClient() (Client, error) {
+	if p.injected != nil {
+		return p.injected, nil
+	}
+	httpClient := p.HTTPClient
+	if httpClient == nil {
+		httpClient = newHTTPClient()
+	}
+	client := linodego.NewClient(httpClient)
+	// linodego retries rate limited and failed requests itself, up to 1000
+	// times and without telling anyone; do is the only retry layer instead.
+	client.SetRetryCount(0)
+	userAgent := p.UserAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+	client.SetUserAgent(userAgent)
+	if token := p.apiToken(); token != "" {
+		client.SetToken(token)
+	}
+	if getToken := p.GetToken; getToken != nil {
+		client.OnBeforeRequest(func(request *linodego.Request) error {
+			token, err := getToken()
+			if err != nil {
+				return fmt.Errorf("could not get API token: %w", err)
+			}
+			request.SetHeader("Authorization", "Bearer "+token)
+			return nil
+		})
+	}
+	if p.APIURL != "" {
+		if err := checkAPIURL(p.APIURL); err != nil {
+			return nil, err
+		}
+		client.SetBaseURL(p.APIURL)
+	}
+	if p.APIVersion != "" {
+		client.SetAPIVersion(p.APIVersion)
+	}
+	if p.Logger != nil {
+		client.SetLogger(p.Logger)
+	}
+	if p.Debug {
+		client.SetDebug(true)
+	}
+	if p.DisableAPICache {
+		client.UseCache(false)
+	}
+	return &client, nil
+}
+
+// apiToken returns APIToken or, if neither it nor GetToken is set, the token
+// in the environment variable named by TokenEnvVar.
+func (p *Provider) apiToken() string {
+	if p.APIToken != "" || p.GetToken != nil {
+		return p.APIToken
+	}
+	envVar := p.TokenEnvVar
+	if envVar == "" {
+		envVar = linodego.APIEnvVar
+	}
+	return os.Getenv(envVar)
+}
+
+// checkAPIURL checks that apiURL is a host name, optionally with a path, or
+// an HTTP or HTTPS URL with a host, so that a malformed APIURL fails before
+// the first request rather than with an obscure error in it.
+func checkAPIURL(apiURL string) error {
+	rawURL := apiURL
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid API URL %q: %w", apiURL, err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return fmt.Errorf("invalid API URL %q: unsupported scheme %q, expected https or http", apiURL, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("invalid API URL %q: no host, expected e.g. api.linode.com or https://api.linode.com", apiURL)
+	}
+	return nil
+}
+
+// newHTTPClient returns the HTTP client used unless HTTPClient is set. It has
+// a transport of its own, so that its connections are not shared with, or
+// tuned by, other users of http.DefaultTransport.
+func newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = 10 * time.Second
+	transport.ResponseHeaderTimeout = 30 * time.Second
+	transport.MaxIdleConns = 16
+	transport.MaxIdleConnsPerHost = 8
+	transport.IdleConnTimeout = 90 * time.Second
+	return &http.Client{Transport: transport}
+}
+
+const (
+	defaultRetryBaseDelay = time.Second
+	defaultRetryMaxDelay  = 30 * time.Second
+)
+
+// apiOperation names a kind of Linode API call.
+type apiOperation string
+
+const (
+	opListDomains        apiOperation = "ListDomains"
+	opGetDomain          apiOperation = "GetDomain"
+	opCreateDomain       apiOperation = "CreateDomain"
+	opUpdateDomain       apiOperation = "UpdateDomain"
+	opListDomainRecords  apiOperation = "ListDomainRecords"
+	opGetDomainRecord    apiOperation = "GetDomainRecord"
+	opCreateDomainRecord apiOperation = "CreateDomainRecord"
+	opUpdateDomainRecord apiOperation = "UpdateDomainRecord"
+	opDeleteDomainRecord apiOperation = "DeleteDomainRecord"
+	opGetProfile         apiOperation = "GetProfile"
+)
+
+// idempotent reports whether repeating the operation is harmless even if
+// an earlier attempt reached Linode.
+func (op apiOperation) idempotent() bool {
+	switch op {
+	case opCreateDomain, opCreateDomainRecord:
+		return false
+	}
+	return true
+}
+
+// targetsDomain reports whether the operation fails with 404 Not Found only
+// if its domain does not exist. Operations on a single record also fail so if
+// the record does not.
+func (op apiOperation) targetsDomain() bool {
+	switch op {
+	case opGetDomain, opUpdateDomain, opListDomainRecords, opCreateDomainRecord:
+		return true
+	}
+	return false
+}
+
+// mutating reports whether the operation changes domains or records.
+func (op apiOperation) mutating() bool {
+	switch op {
+	case opCreateDomain, opUpdateDomain, opCreateDomainRecord, opUpdateDomainRecord, opDeleteDomainRecord:
+		return true
+	}
+	return false
+}
+
+// scope returns the OAuth scope a token needs for the operation, empty if it
+// needs none.
+func (op apiOperation) scope() string {
+	switch {
+	case op == opGetProfile:
+		return ""
+	case op.mutating():
+		return "domains:read_write"
+	}
+	return "domains:read_only"
+}
+
+// do calls fn, retrying it with exponential backoff up to MaxRetries times
+// while Linode responds with 429 Too Many Requests, or while the request
+// fails transiently and op is idempotent or RetryNonIdempotent is set. A
+// Retry-After header on the response takes precedence over the backoff.
+// Each attempt is bounded by the request timeout of op, if set, and every
+// retry is logged to Logger, if set. The call is traced in a single span if a
+// Tracer is set, and reported to Metrics if set.
+func (p *Provider) do(ctx context.Context, op apiOperation, fn func(ctx context.Context) error) (err error) {
+	if p.Metrics != nil {
+		start := time.Now()
+		defer func() {
+			p.Metrics(newAPICall(op, time.Since(start), err))
+		}()
+	}
+	if p.Tracer == nil {
+		return p.retry(ctx, op, fn)
+	}
+	ctx, span := p.startSpan(ctx, op)
+	defer span.End()
+	err = p.retry(ctx, op, fn)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return err
+}
+
+func (p *Provider) retry(ctx context.Context, op apiOperation, fn func(ctx context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		err := p.attempt(ctx, op, fn)
+		if err == nil {
+			return nil
+		}
+		if attempt >= p.MaxRetries || !p.shouldRetry(ctx, op, err) {
+			return scopeError(op, wrapLinodeError(op, err))
+		}
+		delay := p.retryDelay(err, attempt)
+		p.logRetry(op, attempt+1, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// logRetry warns Logger, if set, that op is retried after err, with the
+// number of the retry and how long it waits for it.
+func (p *Provider) logRetry(op apiOperation, retry int, delay time.Duration, err error) {
+	if p.Logger == nil {
+		return
+	}
+	reason := "failed transiently"
+	if linodeErrorCode(err) == http.StatusTooManyRequests {
+		reason = "was rate limited"
+	}
+	p.Logger.Warnf("linode: %s %s, retry %d of %d in %s: %v", op, reason, retry, p.MaxRetries, delay, err)
+}
+
+// scopeError explains a request forbidden by Linode with the scope the API
+// token lacks: a token valid for reading domains is otherwise only found out
+// once a record is changed.
+func scopeError(op apiOperation, err error) error {
+	if scope := op.scope(); scope != "" && errors.Is(err, ErrForbidden) {
+		return fmt.Errorf("the Linode API token may lack the %s scope: %w", scope, err)
+	}
+	return err
+}
+
+func (p *Provider) shouldRetry(ctx context.Context, op apiOperation, err error) bool {
+	if linodeErrorCode(err) == http.StatusTooManyRequests {
+		return true
+	}
+	if ctx.Err() != nil || !isTransientError(err) {
+		return false
+	}
+	return op.idempotent() || p.RetryNonIdempotent
+}
+
+// isTransientError reports whether err is a failure that may not recur, such
+// as a dropped connection or timeout, or a gateway error.
+func isTransientError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	linodeErr, ok := asLinodeError(err)
+	if !ok {
+		return false
+	}
+	switch linodeErr.Code {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case linodego.ErrorFromError:
+		return isNetworkFailure(linodeErr.Message)
+	}
+	return false
+}
+
+// networkFailures are the messages of the errors net/http returns when a
+// connection fails or times out.
+var networkFailures = []string{
+	"connection refused",
+	"connection reset",
+	"broken pipe",
+	"i/o timeout",
+	"TLS handshake timeout",
+	"Client.Timeout exceeded",
+	"context deadline exceeded",
+	"server closed idle connection",
+	"unexpected EOF",
+	": EOF",
+}
+
+// isNetworkFailure reports whether message, the message of an error raised
+// before a response was received, is that of a network failure. linodego
+// keeps only the message of such errors, so errors from GetToken or a bad
+// TLS certificate or URL can't be told apart from network failures in any
+// other way.
+func isNetworkFailure(message string) bool {
+	for _, failure := range networkFailures {
+		if strings.Contains(message, failure) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Provider) attempt(ctx context.Context, op apiOperation, fn func(ctx context.Context) error) error {
+	release, err := p.acquireRequestSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	timeout := p.requestTimeout(op)
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return fn(ctx)
+}
+
+// requestTimeout returns the timeout of a single request for op: MutateTimeout
+// for requests changing domains or records, ListTimeout for the others, and
+// RequestTimeout if the one for op is not set.
+func (p *Provider) requestTimeout(op apiOperation) time.Duration {
+	timeout := p.ListTimeout
+	if op.mutating() {
+		timeout = p.MutateTimeout
+	}
+	if timeout <= 0 {
+		timeout = p.RequestTimeout
+	}
+	return timeout
+}
+
+// retryDelay returns how long to wait before the given retry attempt. Unless
+// Linode says how long to wait, the exponential backoff is randomized between
+// half of it and all of it, so that clients rate limited at the same time do
+// not retry in lockstep.
+func (p *Provider) retryDelay(err error, attempt int) time.Duration {
+	if linodeErr, ok := asLinodeError(err); ok && linodeErr.Response != nil {
+		if retryAfter := linodeErr.Response.Header.Get("Retry-After"); retryAfter != "" {
+			if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+				return time.Duration(seconds) * time.Second
+			}
+			if date, err := http.ParseTime(retryAfter); err == nil {
+				return time.Until(date)
+			}
+		}
+	}
+	baseDelay := p.RetryBaseDelay
+	if baseDelay <= 0 {
+		baseDelay = defaultRetryBaseDelay
+	}
+	maxDelay := p.RetryMaxDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultRetryMaxDelay
+	}
+	delay := baseDelay << attempt
+	if delay <= 0 || delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// asLinodeError extracts the linodego error from err. linodego returns it
+// both by pointer and by value depending on the failure.
+func asLinodeError(err error) (*linodego.Error, bool) {
+	var linodeErr *linodego.Error
+	if errors.As(err, &linodeErr) {
+		return linodeErr, true
+	}
+	var linodeErrValue linodego.Error
+	if errors.As(err, &linodeErrValue) {
+		return &linodeErrValue, true
+	}
+	return nil, false
+}
+
+// linodeErrorCode returns the HTTP status code of a Linode API error, or 0.
+func linodeErrorCode(err error) int {
+	if linodeErr, ok := asLinodeError(err); ok {
+		return linodeErr.Code
+	}
+	return 0
+}
+
+const defaultMaxConcurrency = 4
+
+func (p *Provider) maxConcurrency() int {
+	if p.MaxConcurrency <= 0 {
+		return defaultMaxConcurrency
+	}
+	return p.MaxConcurrency
+}
+
+// acquireRequestSlot waits until fewer than MaxConcurrency requests of the
+// provider are in flight, across all of its calls, and returns the function
+// releasing the slot taken.
+func (p *Provider) acquireRequestSlot(ctx context.Context) (func(), error) {
+	p.mutex.Lock()
+	if p.requestSlots == nil {
+		p.requestSlots = make(chan struct{}, p.maxConcurrency())
+	}
+	requestSlots := p.requestSlots
+	p.mutex.Unlock()
+	select {
+	case requestSlots <- struct{}{}:
+		return func() { <-requestSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// forEach calls fn for every index below n, running up to MaxConcurrency
+// calls at once. The first error cancels the context of the remaining calls
+// and is returned.
+func (p *Provider) forEach(ctx context.Context, n int, fn func(ctx context.Context, i int) error) error {
+	return p.runConcurrently(ctx, n, true, fn)
+}
+
+// forEachAll calls fn for every index below n like forEach, but an error
+// does not stop the remaining calls. The errors of all calls are joined.
+func (p *Provider) forEachAll(ctx context.Context, n int, fn func(ctx context.Context, i int) error) error {
+	return p.runConcurrently(ctx, n, false, fn)
+}
+
+func (p *Provider) runConcurrently(ctx context.Context, n int, failFast bool, fn func(ctx context.Context, i int) error) error {
+	limit := p.maxConcurrency()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	errs := make([]error, n)
+	semaphore := make(chan struct{}, limit)
+	for i := 0; i < n; i++ {
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			if err := fn(ctx, i); err != nil {
+				errs[i] = err
+				if failFast {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if failFast && firstErr != nil {
+		return firstErr
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// normalizeZone returns zone without a trailing dot, so that "example.com."
+// and "example.com" refer to the same Linode domain.
+func normalizeZone(zone string) string {
+	return strings.TrimSuffix(zone, ".")
+}
+
+// zoneKey returns the key under which per-zone state is kept for zone.
+func zoneKey(zone string) string {
+	return strings.ToLower(normalizeZone(zone))
+}
+
+// lockZone locks zone against being resolved concurrently by this provider,
+// so that AutoCreateZone creates its domain only once, and returns the
+// function unlocking it.
+func (p *Provider) lockZone(zone string) func() {
+	p.mutex.Lock()
+	if p.zoneMutexes == nil {
+		p.zoneMutexes = make(map[string]*sync.Mutex)
+	}
+	zoneMutex := lazyMutex(p.zoneMutexes, zoneKey(zone))
+	p.mutex.Unlock()
+	zoneMutex.Lock()
+	return zoneMutex.Unlock
+}
+
+// lockDomain locks the Linode domain with the ID domainID against concurrent
+// operations of this provider and returns the function unlocking it. Zones
+// sharing a domain, such as example.com and sub.example.com, are locked
+// together; operations on other domains are not blocked.
+func (p *Provider) lockDomain(domainID int) func() {
+	p.mutex.Lock()
+	if p.domainMutexes == nil {
+		p.domainMutexes = make(map[int]*sync.Mutex)
+	}
+	domainMutex := lazyMutex(p.domainMutexes, domainID)
+	p.mutex.Unlock()
+	domainMutex.Lock()
+	return domainMutex.Unlock
+}
+
+// lazyMutex returns the mutex of key in mutexes, adding one if there is none.
+func lazyMutex[K comparable](mutexes map[K]*sync.Mutex, key K) *sync.Mutex {
+	mutex, ok := mutexes[key]
+	if !ok {
+		mutex = &sync.Mutex{}
+		mutexes[key] = mutex
+	}
+	return mutex
+}
+
+// resolvedZone is a libdns zone along with the Linode domain holding its
+// records. The zone is either the domain itself or a subdomain of it.
+type resolvedZone struct {
+	// name is the libdns zone without the trailing dot.
+	name string
+	// domain is the name of the Linode domain.
+	domain string
+	// domainID is the ID of the Linode domain.
+	domainID int
+	// defaultTTL is the TTL of the records of the domain stored without one.
+	defaultTTL time.Duration
+	// absoluteNames names records with their fully qualified names, see
+	// AbsoluteNames.
+	absoluteNames bool
+}
+
+// defaultDomainTTL is the TTL Linode applies to the records of a domain that
+// has no default TTL set.
+const defaultDomainTTL = 24 * time.Hour
+
+func newResolvedZone(zone string, domain *linodego.Domain) resolvedZone {
+	defaultTTL := time.Duration(domain.TTLSec) * time.Second
+	if defaultTTL == 0 {
+		defaultTTL = defaultDomainTTL
+	}
+	return resolvedZone{name: normalizeZone(zone), domain: domain.Domain, domainID: domain.ID, defaultTTL: defaultTTL}
+}
+
+// prefix returns the labels of the zone below its Linode domain, e.g. "sub"
+// for the zone "sub.example.com" in the domain "example.com". It is empty if
+// the zone is the domain itself.
+func (z resolvedZone) prefix() string {
+	return relativeName(z.name, z.domain)
+}
+
+type cachedZone struct {
+	zone    resolvedZone
+	expires time.Time
+}
+
+// resolveZone finds the Linode domain of zone: the domain of the same name or,
+// if there is none, the closest parent domain of the zone.
+func (p *Provider) resolveZone(ctx context.Context, zone string) (resolvedZone, error) {
+	defer p.lockZone(zone)()
+	key := zoneKey(zone)
+	if resolved, ok := p.getCachedZone(key); ok {
+		resolved.absoluteNames = p.AbsoluteNames
+		return resolved, nil
+	}
+	resolved, err := p.lookupZone(ctx, zone)
+	if errors.Is(err, ErrZoneNotFound) && p.AutoCreateZone {
+		var domain *linodego.Domain
+		domain, err = p.createDomain(ctx, zone)
+		if err == nil {
+			resolved = newResolvedZone(zone, domain)
+		}
+	}
+	if err != nil {
+		return resolvedZone{}, err
+	}
+	p.setCachedZone(key, resolved)
+	resolved.absoluteNames = p.AbsoluteNames
+	return resolved, nil
+}
+
+func (p *Provider) getCachedZone(key string) (resolvedZone, bool) {
+	if p.ZoneCacheTTL <= 0 || p.DisableAPICache {
+		return resolvedZone{}, false
+	}
+	p.cacheMutex.Lock()
+	defer p.cacheMutex.Unlock()
+	entry, ok := p.zoneCache[key]
+	if !ok {
+		return resolvedZone{}, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(p.zoneCache, key)
+		return resolvedZone{}, false
+	}
+	return entry.zone, true
+}
+
+func (p *Provider) setCachedZone(key string, zone resolvedZone) {
+	if p.ZoneCacheTTL <= 0 || p.DisableAPICache {
+		return
+	}
+	p.cacheMutex.Lock()
+	defer p.cacheMutex.Unlock()
+	if p.zoneCache == nil {
+		p.zoneCache = make(map[string]cachedZone)
+	}
+	p.zoneCache[key] = cachedZone{zone: zone, expires: time.Now().Add(p.ZoneCacheTTL)}
+}
+
+// withZone calls fn with the zone resolved, holding the lock of its Linode
+// domain. If fn fails because the domain of the zone no longer exists, as
+// refreshStaleZone decides, fn is called once more with the zone resolved
+// anew, holding the lock of the new domain.
+func withZone[T any](ctx context.Context, p *Provider, zone string, fn func(resolved resolvedZone) (T, error)) (T, error) {
+	var zero T
+	if err := p.init(); err != nil {
+		return zero, err
+	}
+	resolved, err := p.resolveZone(ctx, zone)
+	if err != nil {
+		return zero, fmt.Errorf("could not find domain ID for zone: %s: %w", zone, err)
+	}
+	unlock := p.lockDomain(resolved.domainID)
+	result, err := fn(resolved)
+	if p.refreshStaleZone(ctx, zone, &resolved, err) {
+		unlock()
+		unlock = p.lockDomain(resolved.domainID)
+		result, err = fn(resolved)
+	}
+	unlock()
+	return result, err
+}
+
+// refreshStaleZone reports whether an operation on the zone that failed with
+// err should be repeated with the zone resolved anew, which it updates
+// resolved to. A domain that Linode no longer finds may have been deleted and
+// recreated with another ID since it was remembered in the zone cache, so its
+// cache entry is dropped and the zone is looked up again; the operation is
+// repeated at most once, and only if the zone now resolves to another domain.
+// A record that Linode does not find says nothing about its domain, so such
+// errors are left alone.
+func (p *Provider) refreshStaleZone(ctx context.Context, zone string, resolved *resolvedZone, err error) bool {
+	if !errors.Is(err, ErrZoneNotFound) || p.ZoneCacheTTL <= 0 || p.DisableAPICache {
+		return false
+	}
+	p.deleteCachedZone(zoneKey(zone))
+	refreshed, lookupErr := p.resolveZone(ctx, zone)
+	if lookupErr != nil || refreshed.domainID == resolved.domainID {
+		return false
+	}
+	*resolved = refreshed
+	return true
+}
+
+func (p *Provider) deleteCachedZone(key string) {
+	p.cacheMutex.Lock()
+	defer p.cacheMutex.Unlock()
+	delete(p.zoneCache, key)
+}
+
+// lookupZone looks up the Linode domains named like zone or one of its
+// parents in a single request, and resolves zone to the closest of them.
+// Its errors leave it to withZone to name the zone.
+func (p *Provider) lookupZone(ctx context.Context, zone string) (resolvedZone, error) {
+	ctx = p.withTraceAttributes(ctx, traceAttribute{"dns.zone", normalizeZone(zone)})
+	candidates := parentDomains(normalizeZone(zone))
+	nodes := make([]linodego.FilterNode, 0, len(candidates))
+	for _, candidate := range candidates {
+		nodes = append(nodes, &linodego.Comp{Column: "domain", Operator: linodego.Eq, Value: strings.ToLower(candidate)})
+	}
+	filter, err := linodego.Or("", "", nodes...).MarshalJSON()
+	if err != nil {
+		return resolvedZone{}, err
+	}
+	domains, err := listAllPages(ctx, p, opListDomains, string(filter), p.apiClient().ListDomains)
+	if err != nil {
+		return resolvedZone{}, fmt.Errorf("could not list domains: %w", err)
+	}
+	for _, candidate := range candidates {
+		domain, err := matchDomain(domains, candidate)
+		if errors.Is(err, ErrZoneNotFound) {
+			continue
+		}
+		if err != nil {
+			return resolvedZone{}, err
+		}
+		return newResolvedZone(zone, &domain), nil
+	}
+	return resolvedZone{}, fmt.Errorf("%w: no domain matches the zone or one of its parents", ErrZoneNotFound)
+}
+
+// matchDomain returns the domain named name, ignoring case. If several
+// domains differ from name only in case, the one spelled exactly like name is
+// returned, and ErrAmbiguousZone if there is none.
+func matchDomain(domains []linodego.Domain, name string) (linodego.Domain, error) {
+	var matches []linodego.Domain
+	for _, domain := range domains {
+		if strings.EqualFold(domain.Domain, name) {
+			matches = append(matches, domain)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return linodego.Domain{}, ErrZoneNotFound
+	case 1:
+		return matches[0], nil
+	}
+	ids := make([]string, 0, len(matches))
+	for _, match := range matches {
+		if match.Domain == name {
+			return match, nil
+		}
+		ids = append(ids, strconv.Itoa(match.ID))
+	}
+	return linodego.Domain{}, fmt.Errorf("%w: %s matches the domains with IDs %s", ErrAmbiguousZone, name, strings.Join(ids, ", "))
+}
+
+// parentDomains returns zone followed by its parent domains, closest first,
+// down to the domain directly below the top-level domain.
+func parentDomains(zone string) []string {
+	domains := []string{zone}
+	for {
+		i := strings.IndexByte(zone, '.')
+		if i < 0 || !strings.Contains(zone[i+1:], ".") {
+			return domains
+		}
+		zone = zone[i+1:]
+		domains = append(domains, zone)
+	}
+}
+
+func (p *Provider) getProfile(ctx context.Context) (*linodego.Profile, error) {
+	var profile *linodego.Profile
+	err := p.do(ctx, opGetProfile, func(ctx context.Context) (err error) {
+		profile, err = p.apiClient().GetProfile(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// createDomain creates a master domain for zone and returns its ID.
+func (p *Provider) createDomain(ctx context.Context, zone string) (*linodego.Domain, error) {
+	domainType := linodego.DomainType(strings.ToLower(p.DomainType))
+	if domainType == "" {
+		domainType = linodego.DomainTypeMaster
+	}
+	if domainType != linodego.DomainTypeMaster && domainType != linodego.DomainTypeSlave {
+		return nil, fmt.Errorf("invalid domain type %q, expected %q or %q", p.DomainType, linodego.DomainTypeMaster, linodego.DomainTypeSlave)
+	}
+	if domainType == linodego.DomainTypeSlave && len(p.MasterIPs) == 0 {
+		return nil, errors.New("slave domains need MasterIPs")
+	}
+	options := linodego.DomainCreateOptions{
+		Domain:    strings.ToLower(normalizeZone(zone)),
+		Type:      domainType,
+		SOAEmail:  p.SOAEmail,
+		MasterIPs: p.MasterIPs,
+		Tags:      p.DomainTags,
+	}
+	var domain *linodego.Domain
+	err := p.do(ctx, opCreateDomain, func(ctx context.Context) (err error) {
+		domain, err = p.apiClient().CreateDomain(ctx, options)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create domain for zone %s: %w", zone, err)
+	}
+	return domain, nil
+}
+
+func (p *Provider) getDomain(ctx context.Context, domainID int) (*linodego.Domain, error) {
+	ctx = p.withTraceAttributes(ctx, traceAttribute{"linode.domain_id", domainID})
+	var domain *linodego.Domain
+	err := p.do(ctx, opGetDomain, func(ctx context.Context) (err error) {
+		domain, err = p.apiClient().GetDomain(ctx, domainID)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not get domain: %w", err)
+	}
+	return domain, nil
+}
+
+func (p *Provider) updateDomain(ctx context.Context, domainID int, options linodego.DomainUpdateOptions) (*linodego.Domain, error) {
+	ctx = p.withTraceAttributes(ctx, traceAttribute{"linode.domain_id", domainID})
+	var domain *linodego.Domain
+	err := p.do(ctx, opUpdateDomain, func(ctx context.Context) (err error) {
+		domain, err = p.apiClient().UpdateDomain(ctx, domainID, options)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not update domain: %w", err)
+	}
+	return domain, nil
+}
+
+// minPageSize and maxPageSize are the smallest and largest page sizes Linode
+// accepts for list requests.
+const (
+	minPageSize = 25
+	maxPageSize = 500
+)
+
+// pageSize returns PageSize raised or lowered to a page size Linode accepts,
+// or zero if PageSize is not set.
+func (p *Provider) pageSize() int {
+	switch {
+	case p.PageSize <= 0:
+		return 0
+	case p.PageSize < minPageSize:
+		return minPageSize
+	case p.PageSize > maxPageSize:
+		return maxPageSize
+	}
+	return p.PageSize
+}
+
+// listAllPages requests the pages of a Linode list endpoint one by one until
+// all of them were retrieved, and returns their combined results.
+func listAllPages[T any](ctx context.Context, p *Provider, op apiOperation, filter string, list func(context.Context, *linodego.ListOptions) ([]T, error)) ([]T, error) {
+	var results []T
+	for page := 1; ; page++ {
+		listOptions := linodego.NewListOptions(page, filter)
+		listOptions.PageSize = p.pageSize()
+		var pageResults []T
+		err := p.do(ctx, op, func(ctx context.Context) (err error) {
+			pageResults, err = list(ctx, listOptions)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, pageResults...)
+		if page >= listOptions.Pages {
+			return results, nil
+		}
+	}
+}
+
+// listDomains lists the domains matching a Linode API filter, all of them if
+// filter is empty.
+func (p *Provider) listDomains(ctx context.Context, filter string) ([]linodego.Domain, error) {
+	domains, err := listAllPages(ctx, p, opListDomains, filter, p.apiClient().ListDomains)
+	if err != nil {
+		return nil, fmt.Errorf("could not list domains: %w", err)
+	}
+	return domains, nil
+}
+
+func (p *Provider) listDomainRecords(ctx context.Context, zone resolvedZone) ([]libdns.Record, error) {
+	return p.listFilteredDomainRecords(ctx, zone, "")
+}
+
+// listFilteredDomainRecords lists the domain records of the zone matching a
+// Linode API filter, all of them if filter is empty, sorted by sortRecords.
+// Records of the Linode domain outside of the zone are left out.
+func (p *Provider) listFilteredDomainRecords(ctx context.Context, zone resolvedZone, filter string) ([]libdns.Record, error) {
+	ctx = p.traceZone(ctx, zone)
+	linodeRecords, err := listAllPages(ctx, p, opListDomainRecords, filter, func(ctx context.Context, listOptions *linodego.ListOptions) ([]linodego.DomainRecord, error) {
+		return p.apiClient().ListDomainRecords(ctx, zone.domainID, listOptions)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list domain records of zone %s: %w", zone.name, err)
+	}
+	records := make([]libdns.Record, 0, len(linodeRecords))
+	for i := range linodeRecords {
+		linodeRecord := &linodeRecords[i]
+		if !inZone(srvName(linodeRecord, linodeRecord.Name), zone) {
+			continue
+		}
+		records = append(records, *convertToLibdns(zone, linodeRecord))
+	}
+	sortRecords(records)
+	return records, nil
+}
+
+// sortRecords sorts records by name, type and value, as Linode does not list
+// them in a stable order.
+func sortRecords(records []libdns.Record) {
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Value < b.Value
+	})
+}
+
+// countDomainRecords counts the domain records of the zone. A single page is
+// requested unless the zone is below its Linode domain, as the total Linode
+// reports covers all the records of the domain.
+func (p *Provider) countDomainRecords(ctx context.Context, zone resolvedZone) (int, error) {
+	if zone.prefix() != "" {
+		records, err := p.listDomainRecords(ctx, zone)
+		if err != nil {
+			return 0, err
+		}
+		return len(records), nil
+	}
+	ctx = p.traceZone(ctx, zone)
+	listOptions := linodego.NewListOptions(1, "")
+	listOptions.PageSize = minPageSize
+	err := p.do(ctx, opListDomainRecords, func(ctx context.Context) error {
+		_, err := p.apiClient().ListDomainRecords(ctx, zone.domainID, listOptions)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not count domain records of zone %s: %w", zone.name, err)
+	}
+	return listOptions.Results, nil
+}
+
+// linodeRecordTimes is the part of a Linode domain record that
+// listRecordTimes needs, including the times linodego does not decode.
+type linodeRecordTimes struct {
+	ID       int     `json:"id"`
+	Name     string  `json:"name"`
+	Service  *string `json:"service"`
+	Protocol *string `json:"protocol"`
+	Created  string  `json:"created"`
+	Updated  string  `json:"updated"`
+}
+
+// linodeTimeLayout is the layout of the times in Linode API responses, which
+// are in UTC.
+const linodeTimeLayout = "2006-01-02T15:04:05"
+
+// listRecordTimes lists when the records of the zone were created and last
+// updated. The records are requested through the Linode client directly,
+// as linodego leaves these times out of its domain records, so other
+// clients given to WithClient do not support this.
+func (p *Provider) listRecordTimes(ctx context.Context, zone resolvedZone) (map[string]RecordTimes, error) {
+	client, ok := p.apiClient().(*linodego.Client)
+	if !ok {
+		return nil, errors.New("record times can only be listed with the Linode client")
+	}
+	ctx = p.traceZone(ctx, zone)
+	linodeRecords, err := listAllPages(ctx, p, opListDomainRecords, "", func(ctx context.Context, listOptions *linodego.ListOptions) ([]linodeRecordTimes, error) {
+		return listDomainRecordTimes(ctx, client, zone.domainID, listOptions)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list domain record times of zone %s: %w", zone.name, err)
+	}
+	times := make(map[string]RecordTimes, len(linodeRecords))
+	for _, linodeRecord := range linodeRecords {
+		name := srvName(&linodego.DomainRecord{Service: linodeRecord.Service, Protocol: linodeRecord.Protocol}, linodeRecord.Name)
+		if !inZone(name, zone) {
+			continue
+		}
+		created, err := time.Parse(linodeTimeLayout, linodeRecord.Created)
+		if err != nil {
+			return nil, fmt.Errorf("invalid creation time of record %d: %w", linodeRecord.ID, err)
+		}
+		updated, err := time.Parse(linodeTimeLayout, linodeRecord.Updated)
+		if err != nil {
+			return nil, fmt.Errorf("invalid update time of record %d: %w", linodeRecord.ID, err)
+		}
+		times[strconv.Itoa(linodeRecord.ID)] = RecordTimes{Created: created, Updated: updated}
+	}
+	return times, nil
+}
+
+// listDomainRecordTimes requests a page of the records of a Linode domain
+// like linodego's ListDomainRecords, keeping their times.
+func listDomainRecordTimes(ctx context.Context, client *linodego.Client, domainID int, listOptions *linodego.ListOptions) ([]linodeRecordTimes, error) {
+	var page struct {
+		linodego.PageOptions
+		Data []linodeRecordTimes `json:"data"`
+	}
+	request := client.R(ctx).SetResult(&page).SetQueryParam("page", strconv.Itoa(listOptions.Page))
+	if listOptions.PageSize > 0 {
+		request.SetQueryParam("page_size", strconv.Itoa(listOptions.PageSize))
+	}
+	response, err := request.Get(fmt.Sprintf("domains/%d/records", domainID))
+	if err != nil {
+		return nil, linodego.NewError(err)
+	}
+	if response.IsError() {
+		return nil, linodego.NewError(response)
+	}
+	listOptions.Pages = page.Pages
+	listOptions.Results = page.Results
+	return page.Data, nil
+}
+
+func (p *Provider) getDomainRecord(ctx context.Context, zone resolvedZone, id string) (*libdns.Record, error) {
+	recordID, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, err
+	}
+	ctx = p.traceZone(ctx, zone)
+	linodeRecord, err := p.getLinodeDomainRecord(ctx, zone, recordID)
+	if err != nil {
+		return nil, err
+	}
+	return convertToLibdns(zone, linodeRecord), nil
+}
+
+// getLinodeDomainRecord gets the Linode domain record with the ID recordID,
+// failing with ErrRecordNotFound if it does not exist or is outside of the
+// zone.
+func (p *Provider) getLinodeDomainRecord(ctx context.Context, zone resolvedZone, recordID int) (*linodego.DomainRecord, error) {
+	var linodeRecord *linodego.DomainRecord
+	err := p.do(ctx, opGetDomainRecord, func(ctx context.Context) (err error) {
+		linodeRecord, err = p.apiClient().GetDomainRecord(ctx, zone.domainID, recordID)
+		return err
+	})
+	if linodeErrorCode(err) == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %w", ErrRecordNotFound, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !inZone(srvName(linodeRecord, linodeRecord.Name), zone) {
+		return nil, fmt.Errorf("%w: record %d is not in the zone %s", ErrRecordNotFound, recordID, zone.name)
+	}
+	return linodeRecord, nil
+}
+
+func (p *Provider) appendRecords(ctx context.Context, zone resolvedZone, records []libdns.Record) ([]libdns.Record, error) {
+	var existingRecords []libdns.Record
+	if p.SkipExisting && len(records) > 0 {
+		var err error
+		existingRecords, err = p.listDomainRecords(ctx, zone)
+		if err != nil {
+			return nil, err
+		}
+	}
+	addedRecords := make([]libdns.Record, len(records))
+	added := make([]bool, len(records))
+	err := p.forEach(ctx, len(records), func(ctx context.Context, i int) error {
+		record := records[i]
+		if existingRecord, ok := findIdenticalRecord(zone, existingRecords, record); ok {
+			addedRecords[i] = existingRecord
+			added[i] = true
+			return nil
+		}
+		// record is a copy, so that merging Linode's response into it
+		// leaves the caller's slice untouched.
+		addedRecord, err := p.createDomainRecord(ctx, zone, &record)
+		if err != nil {
+			return recordError(ChangeCreate, record, err)
+		}
+		addedRecords[i] = *addedRecord
+		added[i] = true
+		return nil
+	})
+	if err != nil {
+		partialRecords := make([]libdns.Record, 0, len(records))
+		for i, addedRecord := range addedRecords {
+			if added[i] {
+				partialRecords = append(partialRecords, addedRecord)
+			}
+		}
+		return partialRecords, err
+	}
+	return addedRecords, nil
+}
+
+func (p *Provider) setRecords(ctx context.Context, zone resolvedZone, records []libdns.Record) ([]libdns.Record, error) {
+	if len(records) == 0 {
+		return []libdns.Record{}, nil
+	}
+	existingRecords, err := p.listDomainRecords(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	currentRecords := append([]libdns.Record(nil), existingRecords...)
+	updatedRecords := make([]libdns.Record, 0, len(records))
+	keptIDs := make(map[string]bool)
+	for _, record := range records {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		change := p.planRecord(zone, currentRecords, record)
+		updatedRecord, err := p.applyChange(ctx, zone, change)
+		if err != nil {
+			return nil, recordError(change.Action, record, err)
+		}
+		updatedRecords = append(updatedRecords, *updatedRecord)
+		keptIDs[updatedRecord.ID] = true
+		// Later records are matched against the zone as it is now, so
+		// that they refer to the same Linode records GetRecords returns.
+		currentRecords = replaceRecord(currentRecords, *updatedRecord)
+	}
+	// The records are only deleted once the new ones are in place, so that
+	// a name does not go without records in between.
+	for _, extraneousRecord := range extraneousRecords(zone, existingRecords, records, keptIDs) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		// A record recreated to rename it may be gone already.
+		if err := p.deleteDomainRecord(ctx, zone, &extraneousRecord); err != nil && !errors.Is(err, ErrRecordNotFound) {
+			return nil, recordError(ChangeDelete, extraneousRecord, err)
+		}
+	}
+	return updatedRecords, nil
+}
+
+// planRecords returns the changes setRecords makes for records, matching them
+// against a simulation of the zone instead of changing it.
+func (p *Provider) planRecords(zone resolvedZone, existingRecords []libdns.Record, records []libdns.Record) []RecordChange {
+	currentRecords := append([]libdns.Record(nil), existingRecords...)
+	changes := make([]RecordChange, 0, len(records))
+	keptIDs := make(map[string]bool)
+	for _, record := range records {
+		change := p.planRecord(zone, currentRecords, record)
+		changes = append(changes, change)
+		keptIDs[change.Record.ID] = true
+		plannedRecord := normalizeRecord(zone, change.Record)
+		if change.Action == ChangeCreate {
+			currentRecords = append(currentRecords, plannedRecord)
+		} else {
+			currentRecords = replaceRecord(currentRecords, plannedRecord)
+		}
+	}
+	for _, extraneousRecord := range extraneousRecords(zone, existingRecords, records, keptIDs) {
+		changes = append(changes, RecordChange{Action: ChangeDelete, Record: extraneousRecord, Existing: extraneousRecord})
+	}
+	return changes
+}
+
+// extraneousRecords returns the existing records that share their name and
+// type with one of records but are not among the records kept by their ID,
+// so that setting records leaves exactly them under each name and type.
+// Records managed by Linode are never extraneous. SPF records are stored as
+// TXT records, so they only replace the TXT records holding an SPF policy,
+// leaving the other TXT records of the name alone.
+func extraneousRecords(zone resolvedZone, existingRecords, records []libdns.Record, keptIDs map[string]bool) []libdns.Record {
+	type nameAndType struct {
+		name, recordType string
+		spf              bool
+	}
+	setGroups := make(map[nameAndType]bool)
+	for _, record := range records {
+		spf := strings.EqualFold(record.Type, "SPF")
+		record = normalizeRecord(zone, record)
+		setGroups[nameAndType{record.Name, record.Type, spf}] = true
+	}
+	var extraneous []libdns.Record
+	for _, existingRecord := range existingRecords {
+		inGroup := setGroups[nameAndType{existingRecord.Name, existingRecord.Type, false}] ||
+			existingRecord.Type == string(linodego.RecordTypeTXT) && isSPFPolicy(existingRecord.Value) && setGroups[nameAndType{existingRecord.Name, existingRecord.Type, true}]
+		if !inGroup || keptIDs[existingRecord.ID] || isManagedRecord(zone, existingRecord) {
+			continue
+		}
+		extraneous = append(extraneous, existingRecord)
+	}
+	return extraneous
+}
+
+// isSPFPolicy reports whether a TXT value is an SPF policy, which RFC 7208
+// says starts with the version "v=spf1".
+func isSPFPolicy(value string) bool {
+	const version = "v=spf1"
+	return len(value) >= len(version) && strings.EqualFold(value[:len(version)], version) && (len(value) == len(version) || value[len(version)] == ' ')
+}
+
+// appliedChanges are the records ApplyChanges appended, set and deleted.
+type appliedChanges struct {
+	appended, set, deleted []libdns.Record
+}
+
+// applyChanges appends, sets and then deletes records in the zone, stopping at
+// the first step that fails.
+func (p *Provider) applyChanges(ctx context.Context, zone resolvedZone, appends, sets, deletes []libdns.Record) (appliedChanges, error) {
+	var changes appliedChanges
+	var err error
+	changes.appended, err = p.appendRecords(ctx, zone, appends)
+	if err != nil {
+		return changes, err
+	}
+	set, err := p.setRecords(ctx, zone, sets)
+	if err != nil {
+		return changes, err
+	}
+	changes.set = set
+	changes.deleted, err = p.deleteRecords(ctx, zone, deletes)
+	return changes, err
+}
+
+// ensureRecord sets record like setRecords, except that a record without an
+// ID that matches no existing record updates the first existing record of the
+// same name and type instead, whatever its value.
+func (p *Provider) ensureRecord(ctx context.Context, zone resolvedZone, record libdns.Record) (*libdns.Record, error) {
+	existingRecords, err := p.listDomainRecords(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	if record.ID == "" {
+		if _, ok := findMatchingRecord(zone, existingRecords, record); !ok {
+			if existingRecord, ok := findRecordByNameAndType(zone, existingRecords, record); ok {
+				record.ID = existingRecord.ID
+			}
+		}
+	}
+	change := p.planRecord(zone, existingRecords, record)
+	ensuredRecord, err := p.applyChange(ctx, zone, change)
+	if err != nil {
+		return nil, recordError(change.Action, record, err)
+	}
+	return ensuredRecord, nil
+}
+
+func (p *Provider) deleteRecords(ctx context.Context, zone resolvedZone, records []libdns.Record) ([]libdns.Record, error) {
+	for i, record := range records {
+		// An empty name would otherwise match every record at the apex.
+		if record.ID == "" && record.Name == "" && record.Type == "" {
+			return nil, fmt.Errorf("invalid record %d to delete: it has no ID, name or type", i)
+		}
+	}
+	var existingRecords []libdns.Record
+	if anyWithoutID(records) {
+		var err error
+		existingRecords, err = p.listDomainRecords(ctx, zone)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var deletableRecords []libdns.Record
+	// givenByID holds whether each deletable record was given by its ID
+	// rather than found among the records of the zone.
+	var givenByID []bool
+	deletableIDs := make(map[string]bool)
+	for _, record := range records {
+		matchingRecords := []libdns.Record{record}
+		if record.ID == "" {
+			matchingRecords = findDeletableRecords(zone, existingRecords, record)
+		}
+		for _, matchingRecord := range matchingRecords {
+			if deletableIDs[matchingRecord.ID] {
+				continue
+			}
+			deletableIDs[matchingRecord.ID] = true
+			deletableRecords = append(deletableRecords, matchingRecord)
+			givenByID = append(givenByID, record.ID != "")
 		}
-		if p.APIURL != "" {
-			p.client.SetBaseURL(p.APIURL)
+	}
+	return p.deleteDeletableRecords(ctx, zone, deletableRecords, givenByID)
+}
+
+// deleteDeletableRecords deletes records in parallel. givenByID holds whether
+// each record was given by its ID rather than found among the records of the
+// zone, and is nil if they were all found there. It returns the records that
+// were deleted, along with the joined errors of the others.
+func (p *Provider) deleteDeletableRecords(ctx context.Context, zone resolvedZone, deletableRecords []libdns.Record, givenByID []bool) ([]libdns.Record, error) {
+	deleted := make([]bool, len(deletableRecords))
+	err := p.forEachAll(ctx, len(deletableRecords), func(ctx context.Context, i int) error {
+		// The Linode domain of a zone below it also holds records outside of
+		// the zone, which must not be deleted through it.
+		if givenByID != nil && givenByID[i] && zone.prefix() != "" {
+			recordID, err := strconv.Atoi(deletableRecords[i].ID)
+			if err != nil {
+				return recordError(ChangeDelete, deletableRecords[i], err)
+			}
+			_, err = p.getLinodeDomainRecord(ctx, zone, recordID)
+			if errors.Is(err, ErrRecordNotFound) && p.IgnoreMissingRecords {
+				return nil
+			}
+			if err != nil {
+				return recordError(ChangeDelete, deletableRecords[i], err)
+			}
 		}
-		if p.APIVersion != "" {
-			p.client.SetAPIVersion(p.APIVersion)
+		if err := p.deleteDomainRecord(ctx, zone, &deletableRecords[i]); err != nil {
+			return recordError(ChangeDelete, deletableRecords[i], err)
 		}
+		deleted[i] = true
+		return nil
 	})
+	deletedRecords := make([]libdns.Record, 0, len(deletableRecords))
+	for i, deletableRecord := range deletableRecords {
+		if deleted[i] {
+			deletedRecords = append(deletedRecords, deletableRecord)
+		}
+	}
+	return deletedRecords, err
 }
 
-func (p *Provider) getDomainIDByZone(ctx context.Context, zone string) (int, error) {
-	f := linodego.Filter{}
-	f.AddField(linodego.Eq, "domain", libdns.AbsoluteName(zone, ""))
-	filter, err := f.MarshalJSON()
-	if err != nil {
-		return 0, err
+// recordError adds the record an action failed for to err, so that the
+// record can be told apart from the others of a batch. Records given only by
+// ID, as they may be for deletes, are named by their ID.
+func recordError(action ChangeAction, record libdns.Record, err error) error {
+	if (record.Type == "" || record.Name == "") && record.ID != "" {
+		return fmt.Errorf("could not %s record %s: %w", action, record.ID, err)
 	}
-	listOptions := linodego.NewListOptions(0, string(filter))
-	domains, err := p.client.ListDomains(ctx, listOptions)
-	if err != nil {
-		return 0, fmt.Errorf("could not list domains: %v", err)
+	return fmt.Errorf("could not %s %s record %q: %w", action, record.Type, record.Name, err)
+}
+
+// replaceRecord replaces the record with the ID of record in records, or
+// appends record if there is none.
+func replaceRecord(records []libdns.Record, record libdns.Record) []libdns.Record {
+	for i, existingRecord := range records {
+		if existingRecord.ID == record.ID {
+			records[i] = record
+			return records
+		}
+	}
+	return append(records, record)
+}
+
+// findRecordByID returns the record with the given ID.
+func findRecordByID(records []libdns.Record, id string) (libdns.Record, bool) {
+	for _, record := range records {
+		if record.ID == id {
+			return record, true
+		}
 	}
-	if len(domains) == 0 {
-		return 0, fmt.Errorf("could not find the domain provided")
+	return libdns.Record{}, false
+}
+
+// anyWithoutID reports whether any of records lacks an ID, in which case the
+// existing records are needed to find the ones it refers to.
+func anyWithoutID(records []libdns.Record) bool {
+	for _, record := range records {
+		if record.ID == "" {
+			return true
+		}
 	}
-	return domains[0].ID, nil
+	return false
 }
 
-func (p *Provider) listDomainRecords(ctx context.Context, zone string, domainID int) ([]libdns.Record, error) {
-	listOptions := linodego.NewListOptions(0, "")
-	linodeRecords, err := p.client.ListDomainRecords(ctx, domainID, listOptions)
-	if err != nil {
-		return nil, fmt.Errorf("could not list domain records: %v", err)
+// planRecord returns the change that sets record: an update of the record
+// with its ID, or of the existing record it matches, or else a creation. An
+// update is left out if the existing record already is as it would be set.
+func (p *Provider) planRecord(zone resolvedZone, existingRecords []libdns.Record, record libdns.Record) RecordChange {
+	var existingRecord libdns.Record
+	var ok bool
+	if record.ID != "" {
+		existingRecord, ok = findRecordByID(existingRecords, record.ID)
+	} else {
+		existingRecord, ok = findMatchingRecord(zone, existingRecords, record)
+		record.ID = existingRecord.ID
 	}
-	records := make([]libdns.Record, 0, len(linodeRecords))
-	for _, linodeRecord := range linodeRecords {
-		records = append(records, *convertToLibdns(zone, &linodeRecord))
+	switch {
+	case record.ID == "" && !ok:
+		return RecordChange{Action: ChangeCreate, Record: record}
+	case ok && p.isUnchanged(zone, existingRecord, record):
+		return RecordChange{Action: ChangeNone, Record: record, Existing: existingRecord}
 	}
-	return records, nil
+	return RecordChange{Action: ChangeUpdate, Record: record, Existing: existingRecord}
 }
 
-func (p *Provider) createOrUpdateDomainRecord(ctx context.Context, zone string, domainID int, record *libdns.Record) (*libdns.Record, error) {
-	if record.ID == "" {
-		addedRecord, err := p.createDomainRecord(ctx, zone, domainID, record)
-		if err != nil {
-			return nil, err
-		}
-		return addedRecord, nil
+// isUnchanged reports whether setting record would leave the existing record
+// as it is, down to its TTL. Records without a TTL keep the existing one when
+// they are updated, so any TTL is left as it is for them.
+func (p *Provider) isUnchanged(zone resolvedZone, existingRecord, record libdns.Record) bool {
+	ttl := time.Duration(p.effectiveTTL(record.TTL)) * time.Second
+	record = normalizeRecord(zone, record)
+	return existingRecord.Type == record.Type && existingRecord.Name == record.Name && sameValue(existingRecord, record) && (ttl == 0 || existingRecord.TTL == ttl)
+}
+
+// applyChange makes a planned change and returns the record as stored by Linode.
+func (p *Provider) applyChange(ctx context.Context, zone resolvedZone, change RecordChange) (*libdns.Record, error) {
+	switch change.Action {
+	case ChangeCreate:
+		return p.createDomainRecord(ctx, zone, &change.Record)
+	case ChangeNone:
+		return &change.Existing, nil
 	}
-	updatedRecord, err := p.updateDomainRecord(ctx, zone, domainID, record)
-	if err != nil {
+	if err := checkUnmanaged(zone, change.Existing); err != nil {
 		return nil, err
 	}
-	return updatedRecord, nil
+	return p.updateDomainRecord(ctx, zone, &change.Record)
 }
 
-func (p *Provider) createDomainRecord(ctx context.Context, zone string, domainID int, record *libdns.Record) (*libdns.Record, error) {
-	addedLinodeRecord, err := p.client.CreateDomainRecord(ctx, domainID, linodego.DomainRecordCreateOptions{
-		Type:   linodego.DomainRecordType(record.Type),
-		Name:   libdns.RelativeName(record.Name, zone),
-		Target: record.Value,
-		TTLSec: int(record.TTL.Seconds()),
+// singleValueTypes are the record types of which a name holds at most one record.
+var singleValueTypes = map[string]bool{
+	"CNAME": true,
+}
+
+// findMatchingRecord returns the existing record that record describes.
+// Records match by name and type, and also by value unless the type holds a
+// single value per name.
+func findMatchingRecord(zone resolvedZone, existingRecords []libdns.Record, record libdns.Record) (libdns.Record, bool) {
+	record = normalizeRecord(zone, record)
+	for _, existingRecord := range existingRecords {
+		if existingRecord.Type != record.Type || existingRecord.Name != record.Name {
+			continue
+		}
+		if singleValueTypes[record.Type] || sameValue(existingRecord, record) {
+			return existingRecord, true
+		}
+	}
+	return libdns.Record{}, false
+}
+
+// findRecordByNameAndType returns the first existing record with the same
+// name and type as record.
+func findRecordByNameAndType(zone resolvedZone, existingRecords []libdns.Record, record libdns.Record) (libdns.Record, bool) {
+	record = normalizeRecord(zone, record)
+	for _, existingRecord := range existingRecords {
+		if existingRecord.Type == record.Type && existingRecord.Name == record.Name {
+			return existingRecord, true
+		}
+	}
+	return libdns.Record{}, false
+}
+
+// findIdenticalRecord returns the existing record with the same name, type
+// and value as record.
+func findIdenticalRecord(zone resolvedZone, existingRecords []libdns.Record, record libdns.Record) (libdns.Record, bool) {
+	record = normalizeRecord(zone, record)
+	for _, existingRecord := range existingRecords {
+		if existingRecord.Type == record.Type && existingRecord.Name == record.Name && sameValue(existingRecord, record) {
+			return existingRecord, true
+		}
+	}
+	return libdns.Record{}, false
+}
+
+// comparableRecord normalizes record like normalizeRecord does for a zone that
+// is not known, taking its name as it is apart from a trailing dot.
+func comparableRecord(record libdns.Record) libdns.Record {
+	record.Name = strings.TrimSuffix(record.Name, ".")
+	if record.Name == apexName {
+		record.Name = ""
+	}
+	record = normalizeRecord(resolvedZone{}, record)
+	record.TTL = time.Duration(snapTTL(record.TTL)) * time.Second
+	return record
+}
+
+// sameValue reports whether two normalized records hold the same data.
+func sameValue(a, b libdns.Record) bool {
+	return a.Value == b.Value && a.Priority == b.Priority
+}
+
+func (p *Provider) createDomainRecord(ctx context.Context, zone resolvedZone, record *libdns.Record) (*libdns.Record, error) {
+	ctx = p.traceRecord(ctx, zone, record)
+	if err := checkUnmanaged(zone, *record); err != nil {
+		return nil, err
+	}
+	options, err := p.recordOptions(zone, record)
+	if err != nil {
+		return nil, err
+	}
+	var addedLinodeRecord *linodego.DomainRecord
+	err = p.do(ctx, opCreateDomainRecord, func(ctx context.Context) error {
+		addedLinodeRecord, err = p.apiClient().CreateDomainRecord(ctx, zone.domainID, options)
+		return err
 	})
 	if err != nil {
 		return nil, err
@@ -85,43 +1514,726 @@ func (p *Provider) createDomainRecord(ctx context.Context, zone string, domainID
 	return mergeWithExistingLibdns(zone, record, addedLinodeRecord), nil
 }
 
-func (p *Provider) updateDomainRecord(ctx context.Context, zone string, domainID int, record *libdns.Record) (*libdns.Record, error) {
+func (p *Provider) updateDomainRecord(ctx context.Context, zone resolvedZone, record *libdns.Record) (*libdns.Record, error) {
+	ctx = p.traceRecord(ctx, zone, record)
+	if err := checkUnmanaged(zone, *record); err != nil {
+		return nil, err
+	}
 	recordID, err := strconv.Atoi(record.ID)
 	if err != nil {
 		return nil, err
 	}
-	updatedLinodeRecord, err := p.client.UpdateDomainRecord(ctx, domainID, recordID, linodego.DomainRecordUpdateOptions{
-		Type:   linodego.DomainRecordType(record.Type),
-		Name:   libdns.RelativeName(record.Name, zone),
-		Target: record.Value,
-		TTLSec: int(record.TTL.Seconds()),
+	options, err := p.recordOptions(zone, record)
+	if err != nil {
+		return nil, err
+	}
+	existingLinodeRecord, err := p.getLinodeDomainRecord(ctx, zone, recordID)
+	if err != nil {
+		return nil, err
+	}
+	updateOptions := overlayUpdateOptions(existingLinodeRecord, options)
+	var updatedLinodeRecord *linodego.DomainRecord
+	err = p.do(ctx, opUpdateDomainRecord, func(ctx context.Context) error {
+		updatedLinodeRecord, err = p.apiClient().UpdateDomainRecord(ctx, zone.domainID, recordID, updateOptions)
+		return err
 	})
 	if err != nil {
 		return nil, err
 	}
+	if options.Name == "" && libdnsName(srvName(updatedLinodeRecord, updatedLinodeRecord.Name), zone) != normalizeRecord(zone, *record).Name {
+		return p.recreateDomainRecord(ctx, zone, record)
+	}
 	return mergeWithExistingLibdns(zone, record, updatedLinodeRecord), nil
 }
 
-func (p *Provider) deleteDomainRecord(ctx context.Context, domainID int, record *libdns.Record) error {
+// overlayUpdateOptions returns the update options setting the fields of
+// options on an existing Linode record, keeping the fields of the existing
+// record that options leaves unset, and its TTL if options has none. They are
+// kept only if the record keeps its type, as they may not apply to another.
+func overlayUpdateOptions(existingLinodeRecord *linodego.DomainRecord, options linodego.DomainRecordCreateOptions) linodego.DomainRecordUpdateOptions {
+	if existingLinodeRecord.Type != options.Type {
+		return linodego.DomainRecordUpdateOptions(options)
+	}
+	updateOptions := existingLinodeRecord.GetUpdateOptions()
+	updateOptions.Name = options.Name
+	updateOptions.Target = options.Target
+	if options.TTLSec != 0 {
+		updateOptions.TTLSec = options.TTLSec
+	}
+	if options.Priority != nil {
+		updateOptions.Priority = options.Priority
+	}
+	if options.Weight != nil {
+		updateOptions.Weight = options.Weight
+	}
+	if options.Port != nil {
+		updateOptions.Port = options.Port
+	}
+	if options.Service != nil {
+		updateOptions.Service = options.Service
+	}
+	if options.Protocol != nil {
+		updateOptions.Protocol = options.Protocol
+	}
+	if options.Tag != nil {
+		updateOptions.Tag = options.Tag
+	}
+	return updateOptions
+}
+
+// recreateDomainRecord replaces the record with the ID of record by a new one,
+// for renames to the domain apex: linodego leaves empty names out of updates,
+// so Linode keeps the old name. The new record is created before the old one
+// is deleted, so that the name does not go missing in between.
+func (p *Provider) recreateDomainRecord(ctx context.Context, zone resolvedZone, record *libdns.Record) (*libdns.Record, error) {
+	newRecord := *record
+	newRecord.ID = ""
+	addedRecord, err := p.createDomainRecord(ctx, zone, &newRecord)
+	if err != nil {
+		return nil, fmt.Errorf("could not rename record %s: %w", record.ID, err)
+	}
+	if err := p.deleteDomainRecord(ctx, zone, &libdns.Record{ID: record.ID}); err != nil {
+		return nil, fmt.Errorf("could not delete record %s after renaming it to record %s: %w", record.ID, addedRecord.ID, err)
+	}
+	return addedRecord, nil
+}
+
+func (p *Provider) deleteDomainRecord(ctx context.Context, zone resolvedZone, record *libdns.Record) error {
+	ctx = p.traceRecord(ctx, zone, record)
+	if err := checkUnmanaged(zone, *record); err != nil {
+		return err
+	}
 	recordID, err := strconv.Atoi(record.ID)
 	if err != nil {
 		return err
 	}
-	return p.client.DeleteDomainRecord(ctx, domainID, recordID)
+	err = p.do(ctx, opDeleteDomainRecord, func(ctx context.Context) error {
+		return p.apiClient().DeleteDomainRecord(ctx, zone.domainID, recordID)
+	})
+	if linodeErrorCode(err) == http.StatusNotFound {
+		if p.IgnoreMissingRecords {
+			return nil
+		}
+		return fmt.Errorf("%w: %w", ErrRecordNotFound, err)
+	}
+	return err
+}
+
+func convertToZoneSettings(domain *linodego.Domain) ZoneSettings {
+	return ZoneSettings{
+		SOAEmail: domain.SOAEmail,
+		TTL:      time.Duration(domain.TTLSec) * time.Second,
+		Refresh:  time.Duration(domain.RefreshSec) * time.Second,
+		Retry:    time.Duration(domain.RetrySec) * time.Second,
+		Expire:   time.Duration(domain.ExpireSec) * time.Second,
+	}
+}
+
+// apexName is the name of records at the zone apex in libdns records.
+const apexName = "@"
+
+// relativeName makes name relative to zone. Unlike libdns.RelativeName, it
+// only strips the zone at a label boundary, so that names like
+// "11.168.192.in-addr.arpa" in reverse zones are not mistaken for names in
+// the zone "1.168.192.in-addr.arpa".
+func relativeName(name, zone string) string {
+	name = strings.TrimSuffix(name, ".")
+	zone = normalizeZone(zone)
+	if strings.EqualFold(name, zone) {
+		return ""
+	}
+	if suffix := "." + zone; len(name) > len(suffix) && strings.EqualFold(name[len(name)-len(suffix):], suffix) {
+		return name[:len(name)-len(suffix)]
+	}
+	return name
+}
+
+// checkWildcard checks that a wildcard label in name is its leftmost label,
+// the only position in which it matches other names.
+func checkWildcard(name string) error {
+	labels := strings.Split(name, ".")
+	for _, label := range labels[1:] {
+		if label == "*" {
+			return fmt.Errorf("invalid record name %q: a wildcard must be the leftmost label", name)
+		}
+	}
+	return nil
+}
+
+// isOutsideZone reports whether name is fully qualified, i.e. ends with a
+// dot, but not the name of zone or of one of its subdomains. Making such a
+// name relative would append the zone to it a second time.
+func isOutsideZone(name, zone string) bool {
+	return strings.HasSuffix(name, ".") && relativeName(name, zone) == strings.TrimSuffix(name, ".")
+}
+
+// linodeName returns the name Linode expects for a record name, relative to
+// the Linode domain of the zone. Linode names the domain apex with an empty
+// string.
+func linodeName(name string, zone resolvedZone) string {
+	name = relativeName(name, zone.name)
+	if name == apexName {
+		name = ""
+	}
+	prefix := zone.prefix()
+	if prefix == "" {
+		return name
+	}
+	if name == "" {
+		return prefix
+	}
+	return name + "." + prefix
+}
+
+// libdnsName returns the name of a Linode record name relative to the zone,
+// naming the zone apex "@", or its fully qualified name with a trailing dot
+// if the zone has absoluteNames set.
+func libdnsName(name string, zone resolvedZone) string {
+	name = relativeName(name, zone.domain)
+	if prefix := zone.prefix(); prefix != "" {
+		name = relativeName(name, prefix)
+	}
+	if zone.absoluteNames {
+		if name == "" {
+			return zone.name + "."
+		}
+		return name + "." + zone.name + "."
+	}
+	if name == "" {
+		return apexName
+	}
+	return name
+}
+
+// inZone reports whether a Linode record name belongs to the zone rather
+// than to another part of its Linode domain.
+func inZone(name string, zone resolvedZone) bool {
+	prefix := zone.prefix()
+	if prefix == "" {
+		return true
+	}
+	name = relativeName(name, zone.domain)
+	return strings.EqualFold(name, prefix) || relativeName(name, prefix) != name
+}
+
+// recordOptions builds the linodego options for record, applying the
+// provider's TTL policy: zero and negative TTLs become DefaultTTL, and
+// positive TTLs below MinTTL are raised to it.
+func (p *Provider) recordOptions(zone resolvedZone, record *libdns.Record) (linodego.DomainRecordCreateOptions, error) {
+	options, err := convertToLinode(zone, record)
+	if err != nil {
+		return options, err
+	}
+	options.TTLSec = p.effectiveTTL(record.TTL)
+	return options, nil
+}
+
+// effectiveTTL returns the TTL, in seconds, a record with ttl is stored with.
+func (p *Provider) effectiveTTL(ttl time.Duration) int {
+	if ttl <= 0 {
+		ttl = p.DefaultTTL
+	}
+	if ttl > 0 && ttl < p.MinTTL {
+		ttl = p.MinTTL
+	}
+	return snapTTL(ttl)
+}
+
+// convertToLinode builds the linodego options for record. The create options
+// are returned as they share their layout with the update options.
+func convertToLinode(zone resolvedZone, record *libdns.Record) (linodego.DomainRecordCreateOptions, error) {
+	if isOutsideZone(record.Name, zone.name) {
+		return linodego.DomainRecordCreateOptions{}, fmt.Errorf("record name %q is not in the zone %q", record.Name, zone.name)
+	}
+	options := linodego.DomainRecordCreateOptions{
+		Type:   linodeType(record.Type),
+		Name:   linodeName(record.Name, zone),
+		Target: record.Value,
+		TTLSec: snapTTL(record.TTL),
+	}
+	if options.Type == "ALIAS" || options.Type == "ANAME" {
+		return options, fmt.Errorf("unsupported record type %q: Linode has no ALIAS records, use A and AAAA records instead", record.Type)
+	}
+	if !supportedTypes[options.Type] {
+		return options, fmt.Errorf("unsupported record type %q", record.Type)
+	}
+	if err := checkWildcard(options.Name); err != nil {
+		return options, err
+	}
+	if options.Type == linodego.RecordTypeCNAME && options.Name == "" {
+		return options, fmt.Errorf("%w %s, use A and AAAA records instead", ErrApexCNAME, zone.domain)
+	}
+	switch options.Type {
+	case linodego.RecordTypeAAAA:
+		options.Target = canonicalIPv6(record.Value)
+	case linodego.RecordTypeMX:
+		priority, target, err := parseMXValue(record)
+		if err != nil {
+			return options, err
+		}
+		options.Priority = &priority
+		options.Target = target
+	case linodego.RecordTypeSRV:
+		service, protocol, name, err := parseSRVName(options.Name)
+		if err != nil {
+			return options, err
+		}
+		priority, weight, port, target, err := parseSRVValue(record)
+		if err != nil {
+			return options, err
+		}
+		options.Name = name
+		options.Service = &service
+		options.Protocol = &protocol
+		options.Priority = &priority
+		options.Weight = &weight
+		options.Port = &port
+		options.Target = target
+	case linodego.RecordTypeTXT:
+		options.Target = encodeTXT(record.Value)
+	case linodego.RecordTypeCAA:
+		tag, value, err := parseCAAValue(record)
+		if err != nil {
+			return options, err
+		}
+		options.Tag = &tag
+		options.Target = value
+	}
+	if err := validateTarget(record.Type, options.Target); err != nil {
+		return options, err
+	}
+	return options, nil
+}
+
+// canonicalIPv6 returns the canonical form of an IPv6 address, e.g.
+// "2001:db8::1" for "2001:0db8:0000::0001", so that records compare equal
+// however their address is written, on either side. Values that are no
+// IPv6 address are returned as they are, for Linode to reject.
+func canonicalIPv6(value string) string {
+	addr, err := netip.ParseAddr(strings.TrimSpace(value))
+	if err != nil || !addr.Is6() {
+		return value
+	}
+	return addr.String()
+}
+
+// validateTarget checks that Linode can store target, explaining the errors
+// the Linode API would otherwise answer vaguely. Only the targets of the types
+// that name a host are checked, as TXT and other values may be anything.
+func validateTarget(recordType, target string) error {
+	switch linodeType(recordType) {
+	case linodego.RecordTypeCNAME, linodego.RecordTypeNS, linodego.RecordTypePTR:
+		if strings.TrimSpace(target) == "" {
+			return fmt.Errorf("invalid %s record: the value must not be empty", recordType)
+		}
+	case linodego.RecordTypeMX, linodego.RecordTypeSRV:
+		if strings.TrimSpace(target) == "." {
+			// RFC 2782 and RFC 7505 use "." to say that a service or
+			// mail server is not available, which Linode cannot store.
+			return fmt.Errorf("invalid %s record: Linode does not support the null target %q", recordType, target)
+		}
+	}
+	return nil
+}
+
+// linodeType returns the Linode record type of a libdns record type, ignoring
+// case. SPF records, which RFC 7208 deprecated in favor of TXT records with
+// the same value and Linode does not have, become TXT records.
+func linodeType(recordType string) linodego.DomainRecordType {
+	recordType = strings.ToUpper(recordType)
+	if recordType == "SPF" {
+		return linodego.RecordTypeTXT
+	}
+	return linodego.DomainRecordType(recordType)
+}
+
+// supportedTypes are the record types Linode can create.
+var supportedTypes = map[linodego.DomainRecordType]bool{
+	linodego.RecordTypeA:     true,
+	linodego.RecordTypeAAAA:  true,
+	linodego.RecordTypeNS:    true,
+	linodego.RecordTypeMX:    true,
+	linodego.RecordTypeCNAME: true,
+	linodego.RecordTypeTXT:   true,
+	linodego.RecordTypeSRV:   true,
+	linodego.RecordTypePTR:   true,
+	linodego.RecordTypeCAA:   true,
+}
+
+// validTTLs are the TTLs, in seconds, that Linode accepts.
+var validTTLs = []int{300, 3600, 7200, 14400, 28800, 57600, 86400, 172800, 345600, 604800, 1209600, 2419200}
+
+// snapTTL returns the valid Linode TTL, in seconds, nearest to ttl, preferring
+// the larger one when ttl lies halfway between two. A zero TTL stays zero so
+// that Linode applies the domain's default, as do negative TTLs. TTLs beyond
+// the largest valid TTL are clamped to it before they are converted, so that
+// enormous durations cannot overflow.
+func snapTTL(ttl time.Duration) int {
+	if ttl <= 0 {
+		return 0
+	}
+	if maxTTL := validTTLs[len(validTTLs)-1]; ttl > time.Duration(maxTTL)*time.Second {
+		return maxTTL
+	}
+	seconds := int(ttl.Seconds())
+	nearest := validTTLs[0]
+	for _, validTTL := range validTTLs[1:] {
+		if absInt(validTTL-seconds) <= absInt(nearest-seconds) {
+			nearest = validTTL
+		}
+	}
+	return nearest
+}
+
+func absInt(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+// parseMXValue returns the priority and mail server of an MX record. The
+// priority is taken from a "10 mail.example.com" style value if present,
+// otherwise from the record's Priority field.
+func parseMXValue(record *libdns.Record) (int, string, error) {
+	fields := strings.Fields(record.Value)
+	switch len(fields) {
+	case 1:
+		return record.Priority, fields[0], nil
+	case 2:
+		priority, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return 0, "", fmt.Errorf("invalid MX priority %q: %w", fields[0], err)
+		}
+		return priority, fields[1], nil
+	default:
+		return 0, "", fmt.Errorf("invalid MX record value: %q", record.Value)
+	}
+}
+
+// parseSRVName splits a relative SRV record name such as "_sip._tcp" or
+// "_sip._tcp.sub" into its service, protocol and remaining name.
+func parseSRVName(name string) (string, string, string, error) {
+	labels := strings.SplitN(name, ".", 3)
+	if len(labels) < 2 || !strings.HasPrefix(labels[0], "_") || !strings.HasPrefix(labels[1], "_") {
+		return "", "", "", fmt.Errorf("invalid SRV record name, expected _service._protocol[.name]: %q", name)
+	}
+	service := strings.TrimPrefix(labels[0], "_")
+	protocol := strings.TrimPrefix(labels[1], "_")
+	if len(labels) == 2 {
+		return service, protocol, "", nil
+	}
+	return service, protocol, labels[2], nil
+}
+
+// parseSRVValue returns the priority, weight, port and target of an SRV
+// record from a "priority weight port target" style value. A value without
+// the priority takes it from the record's Priority field instead.
+func parseSRVValue(record *libdns.Record) (int, int, int, string, error) {
+	fields := strings.Fields(record.Value)
+	if len(fields) == 3 {
+		fields = append([]string{strconv.Itoa(record.Priority)}, fields...)
+	}
+	if len(fields) != 4 {
+		return 0, 0, 0, "", fmt.Errorf("invalid SRV record value: %q", record.Value)
+	}
+	numbers := make([]int, 3)
+	for i, field := range fields[:3] {
+		number, err := strconv.Atoi(field)
+		if err != nil {
+			return 0, 0, 0, "", fmt.Errorf("invalid SRV record value: %q: %w", record.Value, err)
+		}
+		numbers[i] = number
+	}
+	return numbers[0], numbers[1], numbers[2], fields[3], nil
+}
+
+// parseCAAValue returns the tag and value of a CAA record from a
+// "flags tag value" style value, e.g. "0 iodef mailto:security@example.com".
+// Linode does not store the flags, so only the default of 0 is accepted.
+func parseCAAValue(record *libdns.Record) (string, string, error) {
+	fields := strings.Fields(record.Value)
+	if len(fields) < 3 {
+		return "", "", fmt.Errorf("invalid CAA record value: %q", record.Value)
+	}
+	flags, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return "", "", fmt.Errorf("invalid CAA flags %q: %w", fields[0], err)
+	}
+	if flags != 0 {
+		return "", "", fmt.Errorf("unsupported CAA flags %d: Linode only supports 0", flags)
+	}
+	tag := strings.ToLower(fields[1])
+	if !caaTags[tag] {
+		return "", "", fmt.Errorf("unsupported CAA tag %q: Linode supports issue, issuewild and iodef", fields[1])
+	}
+	value := strings.Trim(strings.Join(fields[2:], " "), `"`)
+	if tag == "iodef" && !strings.HasPrefix(value, "mailto:") && !strings.HasPrefix(value, "https:") && !strings.HasPrefix(value, "http:") {
+		return "", "", fmt.Errorf("invalid CAA iodef value %q: expected a mailto:, https: or http: URI", value)
+	}
+	return tag, value, nil
 }
 
-func convertToLibdns(zone string, linodeRecord *linodego.DomainRecord) *libdns.Record {
+// caaTags are the CAA property tags Linode supports.
+var caaTags = map[string]bool{
+	"issue":     true,
+	"issuewild": true,
+	"iodef":     true,
+}
+
+// maxTXTStringLength is the longest character-string a TXT record can hold.
+const maxTXTStringLength = 255
+
+// encodeTXT splits TXT values longer than a single character-string into
+// quoted strings of at most 255 bytes each, as Linode requires. Values holding
+// quotes or backslashes are quoted as well, escaping those characters, so
+// that Linode does not take them for the quoting of the value.
+func encodeTXT(value string) string {
+	if len(value) <= maxTXTStringLength && !strings.ContainsAny(value, `"\`) {
+		return value
+	}
+	return quoteTXTStrings(value)
+}
+
+// quoteTXTStrings splits value into quoted character-strings of at most 255
+// bytes each, separated by spaces.
+func quoteTXTStrings(value string) string {
+	var chunks []string
+	for len(value) > maxTXTStringLength {
+		chunks = append(chunks, quoteTXT(value[:maxTXTStringLength]))
+		value = value[maxTXTStringLength:]
+	}
+	chunks = append(chunks, quoteTXT(value))
+	return strings.Join(chunks, " ")
+}
+
+// quoteTXT quotes a character-string, escaping quotes and backslashes.
+func quoteTXT(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// decodeTXT joins a TXT target split into quoted strings back into a single
+// value, unescaping the characters escaped in them. Targets that are not a
+// sequence of quoted strings are returned as is.
+func decodeTXT(target string) string {
+	if !strings.HasPrefix(target, `"`) {
+		return target
+	}
+	var value strings.Builder
+	for rest := target; rest != ""; {
+		if rest[0] != '"' {
+			return target
+		}
+		s, n, ok := unquoteTXT(rest)
+		if !ok {
+			return target
+		}
+		value.WriteString(s)
+		rest = strings.TrimLeft(rest[n:], " ")
+	}
+	return value.String()
+}
+
+// unquoteTXT reads the quoted character-string at the start of s, returning
+// it unescaped along with the number of bytes it took up in s. Escapes are
+// either a backslash followed by a character standing for itself, or by
+// three decimal digits giving a byte value.
+func unquoteTXT(s string) (string, int, bool) {
+	var unquoted strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return unquoted.String(), i + 1, true
+		case '\\':
+			if i+3 < len(s) && isDigits(s[i+1:i+4]) {
+				b, err := strconv.Atoi(s[i+1 : i+4])
+				if err != nil || b > 255 {
+					return "", 0, false
+				}
+				unquoted.WriteByte(byte(b))
+				i += 3
+				continue
+			}
+			if i+1 >= len(s) {
+				return "", 0, false
+			}
+			i++
+			unquoted.WriteByte(s[i])
+		default:
+			unquoted.WriteByte(s[i])
+		}
+	}
+	return "", 0, false
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// srvName rebuilds the relative name of an SRV record from the service and
+// protocol Linode stores separately.
+func srvName(linodeRecord *linodego.DomainRecord, name string) string {
+	if linodeRecord.Service == nil || linodeRecord.Protocol == nil {
+		return name
+	}
+	prefix := "_" + strings.TrimPrefix(*linodeRecord.Service, "_") + "._" + strings.TrimPrefix(*linodeRecord.Protocol, "_")
+	if name == "" {
+		return prefix
+	}
+	if name == prefix || strings.HasPrefix(name, prefix+".") {
+		return name
+	}
+	return prefix + "." + name
+}
+
+func convertToLibdns(zone resolvedZone, linodeRecord *linodego.DomainRecord) *libdns.Record {
 	return mergeWithExistingLibdns(zone, nil, linodeRecord)
 }
 
-func mergeWithExistingLibdns(zone string, existingRecord *libdns.Record, linodeRecord *linodego.DomainRecord) *libdns.Record {
+// findDeletableRecords returns the existing records that match record by
+// name, and by type and value when those are given. Records managed by Linode
+// only match if the type is given.
+func findDeletableRecords(zone resolvedZone, existingRecords []libdns.Record, record libdns.Record) []libdns.Record {
+	name := libdnsName(linodeName(record.Name, zone), zone)
+	if record.Type != "" && record.Value != "" {
+		record = normalizeRecord(zone, record)
+		name = record.Name
+	}
+	var matchingRecords []libdns.Record
+	for _, existingRecord := range existingRecords {
+		if existingRecord.Name != name {
+			continue
+		}
+		if record.Type == "" && isManagedRecord(zone, existingRecord) {
+			continue
+		}
+		if record.Type != "" && linodeType(existingRecord.Type) != linodeType(record.Type) {
+			continue
+		}
+		if record.Value != "" && !sameValue(existingRecord, record) {
+			continue
+		}
+		matchingRecords = append(matchingRecords, existingRecord)
+	}
+	return matchingRecords
+}
+
+// isManagedRecord reports whether record is managed by Linode itself and
+// cannot be changed through the API: the SOA record and the NS records at the
+// apex of the Linode domain pointing to Linode's name servers. NS records
+// delegating subdomains are not managed.
+func isManagedRecord(zone resolvedZone, record libdns.Record) bool {
+	switch strings.ToUpper(record.Type) {
+	case "SOA":
+		return true
+	case "NS":
+		return linodeName(record.Name, zone) == "" && isLinodeNameServer(record.Value)
+	}
+	return false
+}
+
+// visibleRecords returns records without the ones managed by Linode, unless
+// IncludeManagedRecords is set.
+func (p *Provider) visibleRecords(zone resolvedZone, records []libdns.Record) []libdns.Record {
+	if p.IncludeManagedRecords {
+		return records
+	}
+	visibleRecords := make([]libdns.Record, 0, len(records))
+	for _, record := range records {
+		if !isManagedRecord(zone, record) {
+			visibleRecords = append(visibleRecords, record)
+		}
+	}
+	return visibleRecords
+}
+
+// checkUnmanaged returns an error wrapping ErrManagedRecord if record is
+// managed by Linode.
+func checkUnmanaged(zone resolvedZone, record libdns.Record) error {
+	if isManagedRecord(zone, record) {
+		return fmt.Errorf("%w: %s %s %s", ErrManagedRecord, record.Type, record.Name, record.Value)
+	}
+	return nil
+}
+
+// isLinodeNameServer reports whether host is one of ns1.linode.com through
+// ns5.linode.com.
+func isLinodeNameServer(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for i := 1; i <= 5; i++ {
+		if host == fmt.Sprintf("ns%d.linode.com", i) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeRecord returns record in the form it takes when read back from
+// Linode, so that it can be compared with existing records.
+func normalizeRecord(zone resolvedZone, record libdns.Record) libdns.Record {
+	options, err := convertToLinode(zone, &record)
+	if err != nil {
+		return record
+	}
+	normalizedRecord := convertToLibdns(zone, &linodego.DomainRecord{
+		Type:     options.Type,
+		Name:     options.Name,
+		Target:   options.Target,
+		Priority: intValue(options.Priority),
+		Weight:   intValue(options.Weight),
+		Port:     intValue(options.Port),
+		Service:  options.Service,
+		Protocol: options.Protocol,
+		TTLSec:   options.TTLSec,
+		Tag:      options.Tag,
+	})
+	normalizedRecord.ID = record.ID
+	return *normalizedRecord
+}
+
+func intValue(i *int) int {
+	if i == nil {
+		return 0
+	}
+	return *i
+}
+
+// mergeWithExistingLibdns updates existingRecord with the record Linode
+// returned for it. Every field is taken from Linode, so that the TTL and value
+// are the ones Linode stored after rounding or normalizing them.
+func mergeWithExistingLibdns(zone resolvedZone, existingRecord *libdns.Record, linodeRecord *linodego.DomainRecord) *libdns.Record {
 	if existingRecord == nil {
 		existingRecord = &libdns.Record{}
 	}
 	existingRecord.ID = strconv.Itoa(linodeRecord.ID)
 	existingRecord.Type = string(linodeRecord.Type)
-	existingRecord.Name = libdns.RelativeName(linodeRecord.Name, zone)
+	existingRecord.Name = libdnsName(linodeRecord.Name, zone)
 	existingRecord.Value = linodeRecord.Target
 	existingRecord.TTL = time.Duration(linodeRecord.TTLSec) * time.Second
+	if existingRecord.TTL == 0 {
+		existingRecord.TTL = zone.defaultTTL
+	}
+	existingRecord.Priority = 0
+	switch linodeRecord.Type {
+	case linodego.RecordTypeAAAA:
+		existingRecord.Value = canonicalIPv6(linodeRecord.Target)
+	case linodego.RecordTypeMX:
+		existingRecord.Priority = linodeRecord.Priority
+	case linodego.RecordTypeSRV:
+		existingRecord.Name = libdnsName(srvName(linodeRecord, linodeRecord.Name), zone)
+		existingRecord.Priority = linodeRecord.Priority
+		existingRecord.Value = fmt.Sprintf("%d %d %d %s", linodeRecord.Priority, linodeRecord.Weight, linodeRecord.Port, linodeRecord.Target)
+	case linodego.RecordTypeTXT:
+		existingRecord.Value = decodeTXT(linodeRecord.Target)
+	case linodego.RecordTypeCAA:
+		if linodeRecord.Tag != nil {
+			existingRecord.Value = fmt.Sprintf("0 %s %s", *linodeRecord.Tag, linodeRecord.Target)
+		}
+	}
 	return existingRecord
 }
@@ -0,0 +1,838 @@
+package linode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/linode/linodego"
+)
+
+// newTestServer starts a Linode API stand-in answering every request with
+// handler, and returns a provider sending its requests to it.
+func newTestServer(t *testing.T, handler http.HandlerFunc) *Provider {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return &Provider{APIToken: "token", APIURL: server.URL}
+}
+
+func rateLimited(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", "0")
+	w.WriteHeader(http.StatusTooManyRequests)
+	_, _ = w.Write([]byte(`{"errors": [{"reason": "Too many requests"}]}`))
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := &Provider{RetryBaseDelay: 100 * time.Millisecond, RetryMaxDelay: time.Second}
+	for attempt, maxDelay := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		delays := make(map[time.Duration]bool)
+		for i := 0; i < 100; i++ {
+			delay := p.retryDelay(errors.New("connection reset"), attempt)
+			if delay < maxDelay/2 || delay > maxDelay {
+				t.Fatalf("retry %d: got a delay of %s, want between %s and %s", attempt, delay, maxDelay/2, maxDelay)
+			}
+			delays[delay] = true
+		}
+		if len(delays) < 2 {
+			t.Errorf("retry %d: got the same delay every time, want randomized delays", attempt)
+		}
+	}
+}
+
+func TestRateLimitedRequestsAreRetriedByProvider(t *testing.T) {
+	for _, maxRetries := range []int{0, 2} {
+		var requests atomic.Int32
+		p := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			rateLimited(w)
+		})
+		p.MaxRetries = maxRetries
+		err := p.Ping(context.Background())
+		if !errors.Is(err, ErrRateLimited) {
+			t.Errorf("MaxRetries %d: got error %v, want ErrRateLimited", maxRetries, err)
+		}
+		if got, want := int(requests.Load()), maxRetries+1; got != want {
+			t.Errorf("MaxRetries %d: got %d requests, want %d", maxRetries, got, want)
+		}
+	}
+}
+
+// testLogger records the warnings it receives.
+type testLogger struct {
+	mutex    sync.Mutex
+	warnings []string
+}
+
+func (l *testLogger) Errorf(format string, v ...any) {}
+
+func (l *testLogger) Warnf(format string, v ...any) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.warnings = append(l.warnings, fmt.Sprintf(format, v...))
+}
+
+func (l *testLogger) Debugf(format string, v ...any) {}
+
+func TestRetriesAreLogged(t *testing.T) {
+	p := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		rateLimited(w)
+	})
+	logger := &testLogger{}
+	p.Logger = logger
+	p.MaxRetries = 2
+	_ = p.Ping(context.Background())
+	if len(logger.warnings) != 2 {
+		t.Fatalf("got warnings %q, want one for each of 2 retries", logger.warnings)
+	}
+	for i, warning := range logger.warnings {
+		want := fmt.Sprintf("linode: GetProfile was rate limited, retry %d of 2 in 0s", i+1)
+		if !strings.HasPrefix(warning, want) {
+			t.Errorf("got warning %q, want it to start with %q", warning, want)
+		}
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{linodego.NewError(errors.New(`Get "https://api.linode.com/v4/profile": dial tcp 127.0.0.1:443: connect: connection refused`)), true},
+		{linodego.NewError(errors.New(`Get "https://api.linode.com/v4/profile": read tcp 127.0.0.1:443: read: connection reset by peer`)), true},
+		{linodego.NewError(errors.New(`Get "https://api.linode.com/v4/profile": unexpected EOF`)), true},
+		{linodego.NewError(errors.New(`Get "https://api.linode.com/v4/profile": EOF`)), true},
+		{linodego.NewError(errors.New(`Get "https://api.linode.com/v4/profile": context deadline exceeded`)), true},
+		{&linodego.Error{Code: http.StatusServiceUnavailable}, true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{context.DeadlineExceeded, true},
+		{linodego.NewError(errors.New("could not get API token: vault is sealed")), false},
+		{linodego.NewError(errors.New(`Get "https://api.linode.com/v4/profile": tls: failed to verify certificate: x509: certificate signed by unknown authority`)), false},
+		{linodego.NewError(errors.New(`Get "ftp://api.linode.com/v4/profile": unsupported protocol scheme "ftp"`)), false},
+		{&linodego.Error{Code: http.StatusBadRequest}, false},
+		{errors.New("connection refused"), false},
+	} {
+		if got := isTransientError(test.err); got != test.want {
+			t.Errorf("isTransientError(%v) = %t, want %t", test.err, got, test.want)
+		}
+	}
+}
+
+func TestGetTokenErrorsAreNotRetried(t *testing.T) {
+	var calls atomic.Int32
+	p := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("got a request without a token")
+	})
+	p.APIToken = ""
+	p.GetToken = func() (string, error) {
+		calls.Add(1)
+		return "", errors.New("vault is sealed")
+	}
+	p.MaxRetries = 3
+	if err := p.Ping(context.Background()); err == nil {
+		t.Fatal("got no error, want the GetToken error")
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("got %d calls of GetToken, want 1", got)
+	}
+}
+
+func TestNetworkFailuresAreRetried(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	var calls atomic.Int32
+	p := &Provider{
+		APIURL: server.URL,
+		GetToken: func() (string, error) {
+			calls.Add(1)
+			return "token", nil
+		},
+		MaxRetries:     2,
+		RetryBaseDelay: time.Millisecond,
+		RetryMaxDelay:  time.Millisecond,
+	}
+	if err := p.Ping(context.Background()); err == nil {
+		t.Fatal("got no error from a closed server")
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("got %d requests, want 3", got)
+	}
+}
+
+func TestGetTokenClearedAfterInit(t *testing.T) {
+	var authorization atomic.Value
+	p := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		authorization.Store(r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"username": "user"}`))
+	})
+	p.APIToken = ""
+	p.GetToken = func() (string, error) { return "token", nil }
+	if err := p.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	p.GetToken = nil
+	if err := p.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := authorization.Load(); got != "Bearer token" {
+		t.Errorf("got Authorization %q, want %q", got, "Bearer token")
+	}
+}
+
+func TestRecordError(t *testing.T) {
+	err := errors.New("not found")
+	for _, test := range []struct {
+		record libdns.Record
+		want   string
+	}{
+		{libdns.Record{ID: "123", Type: "A", Name: "www"}, `could not delete A record "www": not found`},
+		{libdns.Record{ID: "123"}, `could not delete record 123: not found`},
+		{libdns.Record{ID: "123", Type: "A"}, `could not delete record 123: not found`},
+		{libdns.Record{Type: "A", Name: "www"}, `could not delete A record "www": not found`},
+	} {
+		got := recordError(ChangeDelete, test.record, err)
+		if got.Error() != test.want {
+			t.Errorf("recordError(%+v) = %q, want %q", test.record, got, test.want)
+		}
+		if !errors.Is(got, err) {
+			t.Errorf("recordError(%+v) does not wrap the error", test.record)
+		}
+	}
+}
+
+func TestValidateTarget(t *testing.T) {
+	for _, test := range []struct {
+		recordType, target string
+		wantErr            bool
+	}{
+		{"MX", ".", true},
+		{"SRV", " . ", true},
+		{"MX", "mail.example.com", false},
+		{"CNAME", "", true},
+		{"NS", " ", true},
+		{"PTR", "", true},
+		{"CNAME", "www.example.com", false},
+		{"TXT", ".", false},
+		{"TXT", " ", false},
+		{"SPF", " ", false},
+		{"CAA", ".", false},
+		{"A", ".", false},
+	} {
+		err := validateTarget(test.recordType, test.target)
+		if (err != nil) != test.wantErr {
+			t.Errorf("validateTarget(%q, %q) = %v, want an error: %t", test.recordType, test.target, err, test.wantErr)
+		}
+	}
+}
+
+func TestReconfigureResizesRequestSlots(t *testing.T) {
+	p := &Provider{APIToken: "token", MaxConcurrency: 1}
+	if _, err := p.acquireRequestSlot(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	p.MaxConcurrency = 2
+	if err := p.Reconfigure(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := p.acquireRequestSlot(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("slot %d: %v", i+1, err)
+		}
+	}
+}
+
+func TestPageSize(t *testing.T) {
+	for pageSize, want := range map[int]int{-1: 0, 0: 0, 1: 25, 25: 25, 100: 100, 500: 500, 1000: 500} {
+		p := &Provider{PageSize: pageSize}
+		if got := p.pageSize(); got != want {
+			t.Errorf("PageSize %d: got %d, want %d", pageSize, got, want)
+		}
+	}
+}
+
+func TestCAARecords(t *testing.T) {
+	p, client := newFakeProvider("example.com")
+	records := []libdns.Record{
+		{Type: "CAA", Name: "@", Value: "0 issue letsencrypt.org"},
+		{Type: "CAA", Name: "@", Value: "0 issuewild ;"},
+		{Type: "CAA", Name: "@", Value: "0 iodef mailto:security@example.com"},
+		{Type: "CAA", Name: "@", Value: "0 iodef https://example.com/caa"},
+		{Type: "CAA", Name: "@", Value: "0 iodef http://example.com/caa"},
+	}
+	if _, err := p.AppendRecords(context.Background(), "example.com.", records); err != nil {
+		t.Fatal(err)
+	}
+	stored := make(map[string]bool)
+	for _, record := range client.domainRecords("example.com") {
+		stored[*record.Tag+" "+record.Target] = true
+	}
+	for _, want := range []string{"issue letsencrypt.org", "issuewild ;", "iodef mailto:security@example.com", "iodef https://example.com/caa", "iodef http://example.com/caa"} {
+		if !stored[want] {
+			t.Errorf("got stored records %v, want the tag and value %q", stored, want)
+		}
+	}
+	got, err := p.GetRecords(context.Background(), "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]bool)
+	for _, record := range got {
+		values[record.Value] = true
+	}
+	for _, record := range records {
+		if !values[record.Value] {
+			t.Errorf("got records %+v, want one with the value %q", got, record.Value)
+		}
+	}
+}
+
+func TestInvalidCAARecords(t *testing.T) {
+	for _, value := range []string{
+		"128 issue letsencrypt.org",
+		"0 contactemail security@example.com",
+		"0 iodef security@example.com",
+		"0 iodef ftp://example.com/caa",
+		"0 issue",
+	} {
+		if _, _, err := parseCAAValue(&libdns.Record{Type: "CAA", Value: value}); err == nil {
+			t.Errorf("parseCAAValue(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestLinodeName(t *testing.T) {
+	domain := &linodego.Domain{ID: 1, Domain: "example.com"}
+	zone := newResolvedZone("example.com.", domain)
+	subZone := newResolvedZone("sub.example.com.", domain)
+	for _, test := range []struct {
+		zone resolvedZone
+		name string
+		want string
+	}{
+		{zone, "@", ""},
+		{zone, "", ""},
+		{zone, "example.com", ""},
+		{zone, "example.com.", ""},
+		{zone, "EXAMPLE.COM.", ""},
+		{zone, "www", "www"},
+		{zone, "www.example.com.", "www"},
+		{zone, "*", "*"},
+		{zone, "a.b", "a.b"},
+		{subZone, "@", "sub"},
+		{subZone, "", "sub"},
+		{subZone, "sub.example.com", "sub"},
+		{subZone, "sub.example.com.", "sub"},
+		{subZone, "www", "www.sub"},
+		{subZone, "www.sub.example.com.", "www.sub"},
+		{subZone, "*", "*.sub"},
+	} {
+		if got := linodeName(test.name, test.zone); got != test.want {
+			t.Errorf("linodeName(%q) in zone %s = %q, want %q", test.name, test.zone.name, got, test.want)
+		}
+	}
+}
+
+func TestLibdnsName(t *testing.T) {
+	domain := &linodego.Domain{ID: 1, Domain: "example.com"}
+	zone := newResolvedZone("example.com.", domain)
+	subZone := newResolvedZone("sub.example.com.", domain)
+	absoluteZone := zone
+	absoluteZone.absoluteNames = true
+	absoluteSubZone := subZone
+	absoluteSubZone.absoluteNames = true
+	for _, test := range []struct {
+		zone resolvedZone
+		name string
+		want string
+	}{
+		{zone, "", "@"},
+		{zone, "www", "www"},
+		{zone, "*", "*"},
+		{zone, "a.b", "a.b"},
+		{subZone, "sub", "@"},
+		{subZone, "www.sub", "www"},
+		{subZone, "*.sub", "*"},
+		{absoluteZone, "", "example.com."},
+		{absoluteZone, "www", "www.example.com."},
+		{absoluteSubZone, "sub", "sub.example.com."},
+		{absoluteSubZone, "www.sub", "www.sub.example.com."},
+	} {
+		if got := libdnsName(test.name, test.zone); got != test.want {
+			t.Errorf("libdnsName(%q) in zone %s = %q, want %q", test.name, test.zone.name, got, test.want)
+		}
+	}
+}
+
+func TestNamesRoundTrip(t *testing.T) {
+	domain := &linodego.Domain{ID: 1, Domain: "example.com"}
+	for _, zone := range []resolvedZone{newResolvedZone("example.com.", domain), newResolvedZone("sub.example.com.", domain)} {
+		for _, name := range []string{"@", "www", "*", "a.b", "_acme-challenge"} {
+			if got := libdnsName(linodeName(name, zone), zone); got != name {
+				t.Errorf("zone %s: %q became %q", zone.name, name, got)
+			}
+		}
+		for _, name := range []string{"", zone.name, zone.name + "."} {
+			if got := libdnsName(linodeName(name, zone), zone); got != "@" {
+				t.Errorf("zone %s: %q became %q, want %q", zone.name, name, got, "@")
+			}
+		}
+	}
+}
+
+func TestMatchDomain(t *testing.T) {
+	domains := []linodego.Domain{
+		{ID: 1, Domain: "example.com"},
+		{ID: 2, Domain: "Other.com"},
+		{ID: 3, Domain: "other.COM"},
+		{ID: 4, Domain: "CASE.com"},
+		{ID: 5, Domain: "Case.com"},
+	}
+	for _, test := range []struct {
+		name    string
+		wantID  int
+		wantErr error
+	}{
+		{"example.com", 1, nil},
+		{"EXAMPLE.com", 1, nil},
+		{"Other.com", 2, nil},
+		{"other.COM", 3, nil},
+		{"other.com", 0, ErrAmbiguousZone},
+		{"case.com", 0, ErrAmbiguousZone},
+		{"missing.com", 0, ErrZoneNotFound},
+	} {
+		domain, err := matchDomain(domains, test.name)
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf("matchDomain(%q): got error %v, want %v", test.name, err, test.wantErr)
+		}
+		if domain.ID != test.wantID {
+			t.Errorf("matchDomain(%q) = domain %d, want %d", test.name, domain.ID, test.wantID)
+		}
+	}
+}
+
+func TestEncodeTXT(t *testing.T) {
+	for _, test := range []struct {
+		value, want string
+	}{
+		{"v=spf1 include:example.net -all", "v=spf1 include:example.net -all"},
+		{`say "hi"`, `"say \"hi\""`},
+		{`back\slash`, `"back\\slash"`},
+		{`"quoted"`, `"\"quoted\""`},
+		{strings.Repeat("a", 256), `"` + strings.Repeat("a", 255) + `" "a"`},
+	} {
+		if got := encodeTXT(test.value); got != test.want {
+			t.Errorf("encodeTXT(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestDecodeTXT(t *testing.T) {
+	for _, test := range []struct {
+		target, want string
+	}{
+		{"v=spf1 -all", "v=spf1 -all"},
+		{`"v=DKIM1; k=rsa; " "p=MIGf"`, "v=DKIM1; k=rsa; p=MIGf"},
+		{`"say \"hi\""`, `say "hi"`},
+		{`"back\\slash"`, `back\slash`},
+		{`"\042.example.com"`, "*.example.com"},
+		{`"unterminated`, `"unterminated`},
+		{`"a" b`, `"a" b`},
+	} {
+		if got := decodeTXT(test.target); got != test.want {
+			t.Errorf("decodeTXT(%q) = %q, want %q", test.target, got, test.want)
+		}
+	}
+}
+
+func TestTXTRoundTrip(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"plain",
+		"with spaces in it",
+		"  leading and trailing spaces  ",
+		`"`,
+		`\`,
+		`a "quoted" word`,
+		`"fully quoted"`,
+		`trailing backslash\`,
+		`\"both\"`,
+		`v=DKIM1; k=rsa; p=` + strings.Repeat(`MIGf\"+/`, 80),
+		strings.Repeat(" ", 300),
+	} {
+		if got := decodeTXT(encodeTXT(value)); got != value {
+			t.Errorf("%q became %q", value, got)
+		}
+	}
+}
+
+func TestSnapTTL(t *testing.T) {
+	for _, test := range []struct {
+		ttl  time.Duration
+		want int
+	}{
+		{math.MinInt64, 0},
+		{-time.Hour, 0},
+		{-time.Nanosecond, 0},
+		{0, 0},
+		{time.Nanosecond, 300},
+		{time.Minute, 300},
+		{1949 * time.Second, 300},
+		{1950 * time.Second, 3600},
+		{time.Hour, 3600},
+		{28 * 24 * time.Hour, 2419200},
+		{365 * 24 * time.Hour, 2419200},
+		{math.MaxInt64, 2419200},
+	} {
+		if got := snapTTL(test.ttl); got != test.want {
+			t.Errorf("snapTTL(%s) = %d, want %d", test.ttl, got, test.want)
+		}
+	}
+}
+
+func TestEffectiveTTL(t *testing.T) {
+	p := &Provider{DefaultTTL: 4 * time.Hour, MinTTL: 2 * time.Hour}
+	for _, test := range []struct {
+		ttl  time.Duration
+		want int
+	}{
+		{math.MinInt64, 14400},
+		{-time.Second, 14400},
+		{0, 14400},
+		{time.Minute, 7200},
+		{math.MaxInt64, 2419200},
+	} {
+		if got := p.effectiveTTL(test.ttl); got != test.want {
+			t.Errorf("effectiveTTL(%s) = %d, want %d", test.ttl, got, test.want)
+		}
+	}
+}
+
+func TestSRVServiceAndProtocol(t *testing.T) {
+	p, client := newFakeProvider("example.com")
+	_, err := p.AppendRecords(context.Background(), "example.com.", []libdns.Record{{Type: "SRV", Name: "_sip._tcp.sub", Value: "10 5 5060 sip.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := client.domainRecords("example.com")
+	if len(stored) != 1 || stored[0].Service == nil || *stored[0].Service != "sip" || stored[0].Protocol == nil || *stored[0].Protocol != "tcp" || stored[0].Name != "sub" {
+		t.Fatalf("got stored records %+v, want the service sip and protocol tcp of the name sub", stored)
+	}
+
+	client.addRecord("example.com", linodego.DomainRecord{Type: "SRV", Name: "", Service: ptr("_xmpp-server"), Protocol: ptr("_tcp"), Target: "xmpp.example.com", Priority: 5, Weight: 0, Port: 5269})
+	client.addRecord("example.com", linodego.DomainRecord{Type: "SRV", Name: "_xmpp-client._tcp", Service: ptr("xmpp-client"), Protocol: ptr("tcp"), Target: "xmpp.example.com", Priority: 5, Weight: 0, Port: 5222})
+	records, err := p.GetRecords(context.Background(), "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]string)
+	for _, record := range records {
+		names[record.Name] = record.Value
+	}
+	for name, value := range map[string]string{
+		"_sip._tcp.sub":     "10 5 5060 sip.example.com",
+		"_xmpp-server._tcp": "5 0 5269 xmpp.example.com",
+		"_xmpp-client._tcp": "5 0 5222 xmpp.example.com",
+	} {
+		if names[name] != value {
+			t.Errorf("got records %v, want %s with the value %q", names, name, value)
+		}
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestGetRecordTimes(t *testing.T) {
+	p := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v4/domains":
+			_, _ = w.Write([]byte(`{"data": [{"id": 1, "domain": "example.com"}], "page": 1, "pages": 1, "results": 1}`))
+		case "/v4/domains/1/records":
+			if r.URL.Query().Get("page") != "1" {
+				t.Errorf("got page %q, want 1", r.URL.Query().Get("page"))
+			}
+			_, _ = w.Write([]byte(`{"data": [
+				{"id": 10, "type": "A", "name": "www.sub", "created": "2023-01-02T03:04:05", "updated": "2023-06-07T08:09:10"},
+				{"id": 11, "type": "SRV", "name": "sub", "service": "_sip", "protocol": "_tcp", "created": "2023-01-02T03:04:05", "updated": "2023-01-02T03:04:05"},
+				{"id": 12, "type": "A", "name": "www", "created": "2023-01-02T03:04:05", "updated": "2023-01-02T03:04:05"}
+			], "page": 1, "pages": 1, "results": 3}`))
+		default:
+			t.Errorf("unexpected request for %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	})
+	times, err := p.GetRecordTimes(context.Background(), "sub.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]RecordTimes{
+		"10": {Created: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC), Updated: time.Date(2023, 6, 7, 8, 9, 10, 0, time.UTC)},
+		"11": {Created: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC), Updated: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)},
+	}
+	if len(times) != len(want) {
+		t.Fatalf("got times %v, want %v", times, want)
+	}
+	for id, wantTimes := range want {
+		if got := times[id]; !got.Created.Equal(wantTimes.Created) || !got.Updated.Equal(wantTimes.Updated) {
+			t.Errorf("record %s: got %+v, want %+v", id, got, wantTimes)
+		}
+	}
+}
+
+func TestGetRecordTimesNeedsTheLinodeClient(t *testing.T) {
+	p, _ := newFakeProvider("example.com")
+	if _, err := p.GetRecordTimes(context.Background(), "example.com."); err == nil {
+		t.Error("got no error from a client given to WithClient")
+	}
+}
+
+func TestParseZoneFile(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		zoneFile string
+		want     []libdns.Record
+	}{
+		{
+			name: "$TTL before the last TTL",
+			zoneFile: "$TTL 1h\n" +
+				"a 300 IN A 192.0.2.1\n" +
+				"b IN A 192.0.2.2\n",
+			want: []libdns.Record{
+				{Type: "A", Name: "a", Value: "192.0.2.1", TTL: 5 * time.Minute},
+				{Type: "A", Name: "b", Value: "192.0.2.2", TTL: time.Hour},
+			},
+		},
+		{
+			name: "last TTL without $TTL",
+			zoneFile: "a 1h30m IN A 192.0.2.1\n" +
+				"b IN A 192.0.2.2\n",
+			want: []libdns.Record{
+				{Type: "A", Name: "a", Value: "192.0.2.1", TTL: 90 * time.Minute},
+				{Type: "A", Name: "b", Value: "192.0.2.2", TTL: 90 * time.Minute},
+			},
+		},
+		{
+			name: "inherited owner",
+			zoneFile: "www 300 IN A 192.0.2.1\n" +
+				"\t300 IN AAAA 2001:db8::1\n" +
+				"    IN TXT hello\n",
+			want: []libdns.Record{
+				{Type: "A", Name: "www", Value: "192.0.2.1", TTL: 5 * time.Minute},
+				{Type: "AAAA", Name: "www", Value: "2001:db8::1", TTL: 5 * time.Minute},
+				{Type: "TXT", Name: "www", Value: "hello", TTL: 5 * time.Minute},
+			},
+		},
+		{
+			name: "parentheses",
+			zoneFile: "@ 300 IN MX ( 10 ; priority\n" +
+				"  mail )\n" +
+				"_sip._tcp 300 IN SRV (\n" +
+				"  10 5 5060\n" +
+				"  sip.example.com. )\n",
+			want: []libdns.Record{
+				{Type: "MX", Name: "@", Value: "10 mail.example.com", TTL: 5 * time.Minute},
+				{Type: "SRV", Name: "_sip._tcp", Value: "10 5 5060 sip.example.com", TTL: 5 * time.Minute},
+			},
+		},
+		{
+			name: "quoted TXT with escapes",
+			zoneFile: `@ 300 IN TXT "v=DKIM1; k=rsa; " "p=MIGf"` + "\n" +
+				`say 300 IN TXT "say \"hi\"\059 back\\slash" ; comment` + "\n" +
+				`caa 300 IN CAA 0 issue "letsencrypt.org"` + "\n",
+			want: []libdns.Record{
+				{Type: "TXT", Name: "@", Value: "v=DKIM1; k=rsa; p=MIGf", TTL: 5 * time.Minute},
+				{Type: "TXT", Name: "say", Value: `say "hi"; back\slash`, TTL: 5 * time.Minute},
+				{Type: "CAA", Name: "caa", Value: "0 issue letsencrypt.org", TTL: 5 * time.Minute},
+			},
+		},
+		{
+			name: "names",
+			zoneFile: "@ 300 IN A 192.0.2.1\n" +
+				"www 300 IN A 192.0.2.2\n" +
+				"abs.example.com. 300 IN A 192.0.2.3\n" +
+				"alias 300 IN CNAME www\n" +
+				"other 300 IN CNAME www.example.net.\n" +
+				"$ORIGIN sub.example.com.\n" +
+				"@ 300 IN A 192.0.2.4\n" +
+				"www 300 IN A 192.0.2.5\n" +
+				"$ORIGIN example.com.\n" +
+				"* 300 IN A 192.0.2.6\n",
+			want: []libdns.Record{
+				{Type: "A", Name: "@", Value: "192.0.2.1", TTL: 5 * time.Minute},
+				{Type: "A", Name: "www", Value: "192.0.2.2", TTL: 5 * time.Minute},
+				{Type: "A", Name: "abs", Value: "192.0.2.3", TTL: 5 * time.Minute},
+				{Type: "CNAME", Name: "alias", Value: "www.example.com", TTL: 5 * time.Minute},
+				{Type: "CNAME", Name: "other", Value: "www.example.net", TTL: 5 * time.Minute},
+				{Type: "A", Name: "sub", Value: "192.0.2.4", TTL: 5 * time.Minute},
+				{Type: "A", Name: "www.sub", Value: "192.0.2.5", TTL: 5 * time.Minute},
+				{Type: "A", Name: "*", Value: "192.0.2.6", TTL: 5 * time.Minute},
+			},
+		},
+		{
+			name: "managed records",
+			zoneFile: "@ 3600 IN SOA ns1.linode.com. admin.example.com. (\n" +
+				"  2023010101 ; serial\n" +
+				"  14400 14400 1209600 86400 )\n" +
+				"@ IN NS ns1.linode.com.\n" +
+				"@ IN NS NS2.LINODE.COM.\n" +
+				"@ IN NS ns1.example.net.\n" +
+				"sub IN NS ns1.linode.com.\n",
+			want: []libdns.Record{
+				{Type: "NS", Name: "@", Value: "ns1.example.net", TTL: time.Hour},
+				{Type: "NS", Name: "sub", Value: "ns1.linode.com", TTL: time.Hour},
+			},
+		},
+	} {
+		got, err := ParseZoneFile(strings.NewReader(test.zoneFile), "example.com.")
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestInvalidZoneFiles(t *testing.T) {
+	for _, zoneFile := range []string{
+		"www.example.net. 300 IN A 192.0.2.1\n",
+		"$ORIGIN example.net.\nwww 300 IN A 192.0.2.1\n",
+		"\t300 IN A 192.0.2.1\n",
+		"www 300 IN A\n",
+		"www 300 IN A 192.0.2.1 192.0.2.2\n",
+		"www 300 IN MX 10\n",
+		"www 300 IN HINFO pc linux\n",
+		"www 300 IN A ( 192.0.2.1\n",
+		"www 300 IN A 192.0.2.1 )\n",
+		`www 300 IN TXT "unterminated` + "\n",
+		"$TTL\n",
+		"$TTL 1x\n",
+		"$ORIGIN\n",
+		"$INCLUDE other.zone\n",
+	} {
+		if records, err := ParseZoneFile(strings.NewReader(zoneFile), "example.com."); err == nil {
+			t.Errorf("%q: got records %v and no error", zoneFile, records)
+		}
+	}
+}
+
+func TestRecordsEqual(t *testing.T) {
+	for _, test := range []struct {
+		a, b libdns.Record
+		want bool
+	}{
+		{libdns.Record{Type: "A", Name: "www", Value: "192.0.2.1"}, libdns.Record{Type: "a", Name: "WWW", Value: "192.0.2.1"}, true},
+		{libdns.Record{Type: "A", Name: "www", Value: "192.0.2.1"}, libdns.Record{Type: "A", Name: "www", Value: "192.0.2.2"}, false},
+		{libdns.Record{Type: "A", Name: "www", Value: "192.0.2.1"}, libdns.Record{Type: "AAAA", Name: "www", Value: "192.0.2.1"}, false},
+		{libdns.Record{Type: "A", Name: "@", Value: "192.0.2.1"}, libdns.Record{Type: "A", Name: "", Value: "192.0.2.1"}, true},
+		{libdns.Record{Type: "A", Name: "@", Value: "192.0.2.1"}, libdns.Record{Type: "A", Name: "www", Value: "192.0.2.1"}, false},
+		{libdns.Record{ID: "1", Type: "A", Name: "www", Value: "192.0.2.1"}, libdns.Record{ID: "2", Type: "A", Name: "www", Value: "192.0.2.1"}, true},
+		{libdns.Record{Type: "A", Name: "www.example.com.", Value: "192.0.2.1"}, libdns.Record{Type: "A", Name: "www.example.com", Value: "192.0.2.1"}, true},
+		{libdns.Record{Type: "A", Name: "www.example.com.", Value: "192.0.2.1"}, libdns.Record{Type: "A", Name: "www", Value: "192.0.2.1"}, false},
+		{libdns.Record{Type: "MX", Name: "@", Value: "10 mail.example.com"}, libdns.Record{Type: "MX", Name: "@", Value: "mail.example.com", Priority: 10}, true},
+		{libdns.Record{Type: "MX", Name: "@", Value: "10 mail.example.com"}, libdns.Record{Type: "MX", Name: "@", Value: "mail.example.com", Priority: 20}, false},
+		{libdns.Record{Type: "SRV", Name: "_sip._tcp", Value: "10 5 5060 sip.example.com"}, libdns.Record{Type: "SRV", Name: "_sip._tcp", Value: " 10  5\t5060 sip.example.com"}, true},
+		{libdns.Record{Type: "SRV", Name: "_sip._tcp", Value: "10 5 5060 sip.example.com"}, libdns.Record{Type: "SRV", Name: "_sip._tcp", Value: "20 5 5060 sip.example.com"}, false},
+		{libdns.Record{Type: "SRV", Name: "_sip._tcp", Value: "10 5 5060 sip.example.com"}, libdns.Record{Type: "SRV", Name: "_sip._tcp", Value: "10 6 5060 sip.example.com"}, false},
+		{libdns.Record{Type: "SRV", Name: "_sip._tcp", Value: "10 5 5060 sip.example.com"}, libdns.Record{Type: "SRV", Name: "_sip._tcp", Value: "10 5 5061 sip.example.com"}, false},
+		{libdns.Record{Type: "SRV", Name: "_sip._tcp", Value: "10 5 5060 sip.example.com"}, libdns.Record{Type: "SRV", Name: "_sip._tcp", Value: "10 5 5060 sip.example.net"}, false},
+		{libdns.Record{Type: "CAA", Name: "@", Value: "0 issue letsencrypt.org"}, libdns.Record{Type: "CAA", Name: "@", Value: `0 ISSUE "letsencrypt.org"`}, true},
+		{libdns.Record{Type: "CAA", Name: "@", Value: "0 issue letsencrypt.org"}, libdns.Record{Type: "CAA", Name: "@", Value: "0 issuewild letsencrypt.org"}, false},
+		{libdns.Record{Type: "CAA", Name: "@", Value: "0 issue letsencrypt.org"}, libdns.Record{Type: "CAA", Name: "@", Value: "0 issue pki.goog"}, false},
+		{libdns.Record{Type: "A", Name: "www", Value: "192.0.2.1", TTL: time.Minute}, libdns.Record{Type: "A", Name: "www", Value: "192.0.2.1", TTL: 5 * time.Minute}, true},
+		{libdns.Record{Type: "A", Name: "www", Value: "192.0.2.1", TTL: 50 * time.Minute}, libdns.Record{Type: "A", Name: "www", Value: "192.0.2.1", TTL: time.Hour}, true},
+		{libdns.Record{Type: "A", Name: "www", Value: "192.0.2.1", TTL: 5 * time.Minute}, libdns.Record{Type: "A", Name: "www", Value: "192.0.2.1", TTL: time.Hour}, false},
+		{libdns.Record{Type: "A", Name: "www", Value: "192.0.2.1"}, libdns.Record{Type: "A", Name: "www", Value: "192.0.2.1", TTL: time.Hour}, false},
+	} {
+		if got := RecordsEqual(test.a, test.b); got != test.want {
+			t.Errorf("RecordsEqual(%+v, %+v) = %t, want %t", test.a, test.b, got, test.want)
+		}
+		if got := RecordsEqual(test.b, test.a); got != test.want {
+			t.Errorf("RecordsEqual(%+v, %+v) = %t, want %t", test.b, test.a, got, test.want)
+		}
+	}
+}
+
+func TestDeleteAllRecordsReturnsPartialResults(t *testing.T) {
+	var mutex sync.Mutex
+	var deletedPaths []string
+	p := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/v4/domains":
+			_, _ = w.Write([]byte(`{"data": [{"id": 1, "domain": "example.com"}], "page": 1, "pages": 1, "results": 1}`))
+		case r.URL.Path == "/v4/domains/1/records" && r.Method == http.MethodGet:
+			_, _ = w.Write([]byte(`{"data": [
+				{"id": 10, "type": "A", "name": "www", "target": "192.0.2.1"},
+				{"id": 11, "type": "A", "name": "api", "target": "192.0.2.2"},
+				{"id": 12, "type": "NS", "name": "", "target": "ns1.linode.com"},
+				{"id": 13, "type": "TXT", "name": "", "target": "hello"}
+			], "page": 1, "pages": 1, "results": 4}`))
+		case strings.HasPrefix(r.URL.Path, "/v4/domains/1/records/") && r.Method == http.MethodDelete:
+			mutex.Lock()
+			deletedPaths = append(deletedPaths, r.URL.Path)
+			mutex.Unlock()
+			if r.URL.Path == "/v4/domains/1/records/11" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"errors": [{"reason": "Cannot delete"}]}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			t.Errorf("unexpected request for %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	})
+	deleted, err := p.DeleteAllRecords(context.Background(), "example.com.")
+	if err == nil || !strings.Contains(err.Error(), `"api"`) {
+		t.Errorf("got error %v, want one for the record api", err)
+	}
+	deletedIDs := make(map[string]bool)
+	for _, record := range deleted {
+		deletedIDs[record.ID] = true
+	}
+	if len(deleted) != 2 || !deletedIDs["10"] || !deletedIDs["13"] {
+		t.Errorf("got deleted records %+v, want the records 10 and 13", deleted)
+	}
+	if len(deletedPaths) != 3 {
+		t.Errorf("got deletes %v, want every record but the NS record of Linode deleted", deletedPaths)
+	}
+}
+
+func TestListZonesFilteredDropsLeadingWildcard(t *testing.T) {
+	for _, nameContains := range []string{"*.prod.example.com", ".prod.example.com", ".Prod.Example.Com."} {
+		p := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			want := `{"domain":{"+contains":".prod.example.com"}}`
+			if got := r.Header.Get("X-Filter"); got != want {
+				t.Errorf("NameContains %q: got filter %s, want %s", nameContains, got, want)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"data": [{"id": 1, "domain": "a.prod.example.com"}], "page": 1, "pages": 1, "results": 1}`))
+		})
+		zones, err := p.ListZonesFiltered(context.Background(), ZoneFilter{NameContains: nameContains})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(zones) != 1 || zones[0].Name != "a.prod.example.com." {
+			t.Errorf("NameContains %q: got zones %v", nameContains, zones)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package linode
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	// ErrMissingToken is returned when no API token is configured.
+	ErrMissingToken = errors.New("no Linode API token configured")
+	// ErrZoneNotFound is returned when no Linode domain matches the zone, or
+	// when the domain of the zone no longer exists.
+	ErrZoneNotFound = errors.New("could not find the domain provided")
+	// ErrRecordNotFound is returned when a record to get or delete by its ID
+	// does not exist.
+	ErrRecordNotFound = errors.New("record not found")
+	// ErrAmbiguousZone is returned when several Linode domains match the
+	// zone and none of them is spelled exactly like it.
+	ErrAmbiguousZone = errors.New("several Linode domains match the zone")
+	// ErrManagedRecord is returned when changing a record managed by Linode
+	// itself, i.e. the SOA record or the apex NS records of a domain.
+	ErrManagedRecord = errors.New("record is managed by Linode")
+	// ErrApexCNAME is returned when creating a CNAME record at the apex of a
+	// Linode domain, which DNS does not allow next to its SOA and NS records.
+	// Linode has no ALIAS records to use there instead.
+	ErrApexCNAME = errors.New("CNAME records are not allowed at the domain apex")
+	// ErrUnauthorized is returned when Linode rejects the API token.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrForbidden is returned when the API token may not perform the request.
+	ErrForbidden = errors.New("forbidden")
+	// ErrRateLimited is returned when Linode keeps rate limiting a request.
+	ErrRateLimited = errors.New("rate limited")
+)
+
+// wrapLinodeError wraps err, returned for op, with the sentinel error matching
+// its HTTP status code, keeping the underlying *linodego.Error available to
+// errors.As. A 404 Not Found is wrapped with ErrZoneNotFound if op fails so
+// only for a missing domain.
+func wrapLinodeError(op apiOperation, err error) error {
+	switch linodeErrorCode(err) {
+	case http.StatusNotFound:
+		if op.targetsDomain() {
+			return fmt.Errorf("%w: %w", ErrZoneNotFound, err)
+		}
+	case http.StatusUnauthorized:
+		return fmt.Errorf("%w: %w", ErrUnauthorized, err)
+	case http.StatusForbidden:
+		return fmt.Errorf("%w: %w", ErrForbidden, err)
+	case http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %w", ErrRateLimited, err)
+	}
+	return err
+}
@@ -0,0 +1,28 @@
+package linode
+
+import (
+	"time"
+
+	"github.com/linode/linodego"
+)
+
+// APICall describes a finished Linode API call for the Metrics hook.
+type APICall struct {
+	// Operation is the name of the linodego method called, e.g. "CreateDomainRecord".
+	Operation string
+	// Duration is how long the call took, including retries.
+	Duration time.Duration
+	// Err is the error the call failed with, nil if it succeeded.
+	Err error
+	// StatusCode is the HTTP status code Linode answered a failed call with.
+	// It is zero for successful calls and for failures without a response.
+	StatusCode int
+}
+
+func newAPICall(op apiOperation, duration time.Duration, err error) APICall {
+	call := APICall{Operation: string(op), Duration: duration, Err: err}
+	if code := linodeErrorCode(err); code >= 100 && code != linodego.ErrorFromError {
+		call.StatusCode = code
+	}
+	return call
+}
@@ -4,8 +4,12 @@ package linode
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/libdns/libdns"
 	"github.com/linode/linodego"
@@ -15,90 +19,678 @@ import (
 type Provider struct {
 	// APIToken is the Linode Personal Access Token, see https://cloud.linode.com/profile/tokens.
 	APIToken string `json:"api_token,omitempty"`
-	// APIURL is the Linode API hostname, i.e. "api.linode.com".
+	// GetToken, if set, is called before every request to get the token to
+	// authenticate with, taking precedence over APIToken. This allows the
+	// use of short-lived tokens.
+	GetToken func() (string, error) `json:"-"`
+	// TokenEnvVar is the environment variable the token is read from when
+	// neither APIToken nor GetToken is set. It defaults to "LINODE_TOKEN".
+	TokenEnvVar string `json:"token_env_var,omitempty"`
+	// HTTPClient, if set, sends the Linode API requests. By default, a client
+	// with its own connection pool and dial, TLS handshake and response
+	// header timeouts is used.
+	HTTPClient *http.Client `json:"-"`
+	// APIURL is the Linode API hostname, i.e. "api.linode.com", or its URL,
+	// e.g. "https://api.linode.com". A malformed APIURL fails every call.
 	APIURL string `json:"api_url,omitempty"`
 	// APIVersion is the Linode API version, i.e. "v4".
 	APIVersion string `json:"api_version,omitempty"`
-	client     linodego.Client
-	once       sync.Once
-	mutex      sync.Mutex
+	// UserAgent is sent with every Linode API request. It defaults to "libdns-linode".
+	UserAgent string `json:"user_agent,omitempty"`
+	// ZoneCacheTTL is how long the Linode domain of a zone is remembered
+	// before it is looked up again. Zero disables the cache. A zone is looked
+	// up again early when Linode no longer finds its domain, and the call
+	// repeated once if the zone moved to another domain, e.g. after it was
+	// deleted and recreated. Records Linode does not find leave the cache
+	// alone.
+	ZoneCacheTTL time.Duration `json:"zone_cache_ttl,omitempty"`
+	// DisableAPICache turns off the response cache of the Linode client and
+	// the zone cache, so that every lookup reaches the live API, e.g. for
+	// read-after-write checks.
+	DisableAPICache bool `json:"disable_api_cache,omitempty"`
+	// AutoCreateZone creates the Linode domain of a zone that does not exist
+	// yet instead of failing with ErrZoneNotFound.
+	AutoCreateZone bool `json:"auto_create_zone,omitempty"`
+	// SOAEmail is the SOA email address of domains created by AutoCreateZone.
+	// Linode requires it for master domains.
+	SOAEmail string `json:"soa_email,omitempty"`
+	// DomainType is the type of domains created by AutoCreateZone: "master",
+	// the default, or "slave" for secondary domains transferred from the
+	// name servers at MasterIPs.
+	DomainType string `json:"domain_type,omitempty"`
+	// MasterIPs are the IP addresses of the primary name servers slave
+	// domains created by AutoCreateZone are transferred from.
+	MasterIPs []string `json:"master_ips,omitempty"`
+	// DomainTags are the tags of domains created by AutoCreateZone.
+	DomainTags []string `json:"domain_tags,omitempty"`
+	// DefaultTTL is the TTL of records created or updated without one. If it
+	// is zero, records created without a TTL get the domain's default TTL
+	// and records updated without one keep theirs.
+	DefaultTTL time.Duration `json:"default_ttl,omitempty"`
+	// MinTTL is the lowest TTL records are created or updated with; lower
+	// TTLs are raised to it.
+	MinTTL time.Duration `json:"min_ttl,omitempty"`
+	// MaxRetries is how many times a request rate limited by Linode, or one
+	// failing transiently, is retried before giving up. Zero disables retries.
+	MaxRetries int `json:"max_retries,omitempty"`
+	// RetryBaseDelay is the backoff before the first retry, doubling with
+	// every further retry. It defaults to one second.
+	RetryBaseDelay time.Duration `json:"retry_base_delay,omitempty"`
+	// RetryMaxDelay caps the backoff between retries. It defaults to 30
+	// seconds. Backoffs are randomized between half of them and all of
+	// them, while a Retry-After header from Linode is followed exactly.
+	RetryMaxDelay time.Duration `json:"retry_max_delay,omitempty"`
+	// RetryNonIdempotent also retries requests that create domains or records
+	// after transient failures, at the risk of creating them twice. Rate
+	// limited requests are always retried.
+	RetryNonIdempotent bool `json:"retry_non_idempotent,omitempty"`
+	// PageSize is how many domains or records each page of a Linode list
+	// request holds, between 25 and 500, e.g. to list large zones in fewer
+	// requests; sizes outside that range are raised or lowered into it. Zero
+	// leaves it to Linode, which returns 100 per page.
+	PageSize int `json:"page_size,omitempty"`
+	// MaxConcurrency is how many records AppendRecords creates, or
+	// DeleteRecords deletes, in parallel, and how many Linode API requests
+	// the provider sends at once across all of its calls, including those
+	// of concurrent goroutines. It defaults to 4. The limit applies to each
+	// provider on its own: those returned by Clone and WithToken have limits
+	// of their own. Changes take effect after Reconfigure.
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
+	// SkipExisting makes AppendRecords return the existing record instead of
+	// creating a duplicate when a record of the same name, type and value
+	// already exists.
+	SkipExisting bool `json:"skip_existing,omitempty"`
+	// RequestTimeout bounds how long a single Linode API request may take,
+	// counting from when it is sent, so that every request, including each
+	// retry, gets a fresh deadline within the caller's context. Zero leaves
+	// requests bounded only by the caller's context.
+	RequestTimeout time.Duration `json:"request_timeout,omitempty"`
+	// ListTimeout bounds single requests that only read, such as listing or
+	// getting domains and records, in place of RequestTimeout, e.g. to allow
+	// the pages of large zones more time. Zero leaves them to RequestTimeout.
+	ListTimeout time.Duration `json:"list_timeout,omitempty"`
+	// MutateTimeout bounds single requests that create, update or delete
+	// domains and records in place of RequestTimeout. Zero leaves them to
+	// RequestTimeout.
+	MutateTimeout time.Duration `json:"mutate_timeout,omitempty"`
+	// IgnoreMissingRecords makes DeleteRecords treat records that no longer
+	// exist as deleted, instead of failing with ErrRecordNotFound.
+	IgnoreMissingRecords bool `json:"ignore_missing_records,omitempty"`
+	// AbsoluteNames makes the provider return records with their fully
+	// qualified names with a trailing dot, e.g. "www.example.com.", instead
+	// of names relative to the zone, e.g. "www", and "@" for the apex.
+	AbsoluteNames bool `json:"absolute_names,omitempty"`
+	// IncludeManagedRecords makes GetRecords and GetRecordsFiltered return the
+	// records managed by Linode itself, i.e. the SOA record and the apex NS
+	// records of a domain, which cannot be changed. They are left out by
+	// default.
+	IncludeManagedRecords bool `json:"include_managed_records,omitempty"`
+	// Debug logs the raw Linode API requests and responses.
+	Debug bool `json:"debug,omitempty"`
+	// Tracer, if set, traces every Linode API call in a span, with the zone,
+	// domain ID and record type as attributes.
+	Tracer Tracer `json:"-"`
+	// Metrics, if set, is called after every Linode API call with its
+	// operation, duration and outcome, e.g. to export them to Prometheus.
+	Metrics func(APICall) `json:"-"`
+	// Logger receives the log output of the Linode client, and a warning
+	// for every retried request with the reason and the wait before the
+	// retry. The client logs to the standard logger if it is not set, while
+	// retries are not logged.
+	Logger      linodego.Logger `json:"-"`
+	client      Client
+	clientMutex sync.Mutex
+	initErr     error
+	mutex       sync.Mutex
+	zoneMutexes map[string]*sync.Mutex
+	cacheMutex  sync.Mutex
+	zoneCache   map[string]cachedZone
+	tokenScoped map[string]*Provider
+	// requestSlots holds a value for every request in flight, up to
+	// MaxConcurrency.
+	requestSlots chan struct{}
+	// domainMutexes serialize the calls on each Linode domain.
+	domainMutexes map[int]*sync.Mutex
+	// injected is the client given to WithClient.
+	injected Client
 }
 
-// GetRecords lists all the records in the zone.
-func (p *Provider) GetRecords(ctx context.Context, zone string) ([]libdns.Record, error) {
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
-	p.init(ctx)
-	domainID, err := p.getDomainIDByZone(ctx, zone)
-	if err != nil {
-		return nil, fmt.Errorf("could not find domain ID for zone: %s: %v", zone, err)
+// Validate checks that an API token is configured and that Linode accepts it,
+// so that misconfiguration is caught before any record is touched. A client
+// given to WithClient carries its own token, so only the request is checked
+// for it.
+func (p *Provider) Validate(ctx context.Context) error {
+	if p.injected == nil && p.apiToken() == "" && p.GetToken == nil {
+		return ErrMissingToken
 	}
-	records, err := p.listDomainRecords(ctx, zone, domainID)
-	if err != nil {
-		return nil, err
+	if err := p.init(); err != nil {
+		return err
+	}
+	if _, err := p.getProfile(ctx); err != nil {
+		if errors.Is(err, ErrUnauthorized) {
+			return fmt.Errorf("the Linode API token was rejected: %w", err)
+		}
+		return fmt.Errorf("could not validate the Linode API token: %w", err)
 	}
-	return records, nil
+	return nil
 }
 
-// AppendRecords adds records to the zone. It returns the records that were added.
-func (p *Provider) AppendRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
-	p.init(ctx)
-	domainID, err := p.getDomainIDByZone(ctx, zone)
-	if err != nil {
-		return nil, fmt.Errorf("could not find domain ID for zone: %s: %v", zone, err)
+// Ping checks that the Linode API is reachable and accepts the token with a
+// single request for the token's profile, without touching any zone, e.g.
+// for readiness probes.
+func (p *Provider) Ping(ctx context.Context) error {
+	if err := p.init(); err != nil {
+		return err
+	}
+	if _, err := p.getProfile(ctx); err != nil {
+		return fmt.Errorf("could not reach the Linode API: %w", err)
 	}
-	addedRecords := make([]libdns.Record, 0, len(records))
-	for _, record := range records {
-		addedRecord, err := p.createDomainRecord(ctx, zone, domainID, &record)
+	return nil
+}
+
+// ResolveZone returns the ID of the Linode domain of the zone, e.g. to
+// correlate changes with the Linode dashboard. For a zone without a Linode
+// domain of its own, this is the domain of its closest parent.
+func (p *Provider) ResolveZone(ctx context.Context, zone string) (int, error) {
+	return withZone(ctx, p, zone, func(resolved resolvedZone) (int, error) {
+		return resolved.domainID, nil
+	})
+}
+
+// GetRecords lists all the records in the zone, sorted by name, type and
+// value, except for the ones managed by Linode unless IncludeManagedRecords
+// is set. A zone without records gives an empty, non-nil slice, while a zone
+// without a Linode domain fails with ErrZoneNotFound unless AutoCreateZone is
+// set.
+func (p *Provider) GetRecords(ctx context.Context, zone string) ([]libdns.Record, error) {
+	return withZone(ctx, p, zone, func(resolved resolvedZone) ([]libdns.Record, error) {
+		records, err := p.listDomainRecords(ctx, resolved)
 		if err != nil {
 			return nil, err
 		}
-		addedRecords = append(addedRecords, *addedRecord)
+		return p.visibleRecords(resolved, records), nil
+	})
+}
+
+// GetRecordsForZones lists the records of several zones, listing up to
+// MaxConcurrency zones in parallel. It returns the records of every zone that
+// could be listed, along with the joined errors of the others.
+func (p *Provider) GetRecordsForZones(ctx context.Context, zones []string) (map[string][]libdns.Record, error) {
+	zoneRecords := make([][]libdns.Record, len(zones))
+	err := p.forEachAll(ctx, len(zones), func(ctx context.Context, i int) error {
+		records, err := p.GetRecords(ctx, zones[i])
+		if err != nil {
+			return fmt.Errorf("zone %s: %w", zones[i], err)
+		}
+		zoneRecords[i] = records
+		return nil
+	})
+	recordsByZone := make(map[string][]libdns.Record, len(zones))
+	for i, zone := range zones {
+		if zoneRecords[i] != nil {
+			recordsByZone[zone] = zoneRecords[i]
+		}
 	}
-	return addedRecords, nil
+	return recordsByZone, err
+}
+
+// GetRecord returns the record of the zone with the given ID, requesting only
+// that record instead of listing the zone.
+func (p *Provider) GetRecord(ctx context.Context, zone string, id string) (libdns.Record, error) {
+	return withZone(ctx, p, zone, func(resolved resolvedZone) (libdns.Record, error) {
+		record, err := p.getDomainRecord(ctx, resolved, id)
+		if err != nil {
+			return libdns.Record{}, err
+		}
+		return *record, nil
+	})
+}
+
+// RecordTimes are when Linode created a record and last updated it.
+type RecordTimes struct {
+	Created time.Time
+	Updated time.Time
+}
+
+// GetRecordTimes returns when the records of the zone were created and last
+// updated, by record ID, e.g. to sync only the records changed since an
+// earlier sync. libdns records have no fields for these times. Providers
+// returned by WithClient do not support this, as the times are not part of
+// the records the Client interface returns.
+func (p *Provider) GetRecordTimes(ctx context.Context, zone string) (map[string]RecordTimes, error) {
+	return withZone(ctx, p, zone, func(resolved resolvedZone) (map[string]RecordTimes, error) {
+		return p.listRecordTimes(ctx, resolved)
+	})
+}
+
+// CountRecords returns how many records the zone has, taking the total Linode
+// reports with the first page of its records instead of listing all of them.
+// The count includes any records managed by Linode. For a zone below its
+// Linode domain, the records of the domain are listed to count the ones in the
+// zone.
+func (p *Provider) CountRecords(ctx context.Context, zone string) (int, error) {
+	return withZone(ctx, p, zone, func(resolved resolvedZone) (int, error) {
+		return p.countDomainRecords(ctx, resolved)
+	})
+}
+
+// RecordFilter constrains the records returned by GetRecordsFiltered.
+// Empty fields match any record.
+type RecordFilter struct {
+	// Type is the record type, e.g. "TXT".
+	Type string
+	// NamePrefix is the prefix of the record name relative to the zone, e.g. "_acme-challenge".
+	NamePrefix string
+	// IncludeManaged also returns the records managed by Linode, like
+	// IncludeManagedRecords does for every call, e.g. to list a zone in full
+	// for a backup.
+	IncludeManaged bool
+}
+
+// GetRecordsFiltered lists the records in the zone that match filter. The type
+// is filtered by the Linode API, the name prefix once the records are listed.
+func (p *Provider) GetRecordsFiltered(ctx context.Context, zone string, filter RecordFilter) ([]libdns.Record, error) {
+	var apiFilter string
+	if filter.Type != "" {
+		f := linodego.Filter{}
+		f.AddField(linodego.Eq, "type", linodeType(filter.Type))
+		marshaledFilter, err := f.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		apiFilter = string(marshaledFilter)
+	}
+	return withZone(ctx, p, zone, func(resolved resolvedZone) ([]libdns.Record, error) {
+		records, err := p.listFilteredDomainRecords(ctx, resolved, apiFilter)
+		if err != nil {
+			return nil, err
+		}
+		if !filter.IncludeManaged {
+			records = p.visibleRecords(resolved, records)
+		}
+		if filter.NamePrefix == "" {
+			return records, nil
+		}
+		filteredRecords := make([]libdns.Record, 0, len(records))
+		for _, record := range records {
+			if strings.HasPrefix(record.Name, filter.NamePrefix) {
+				filteredRecords = append(filteredRecords, record)
+			}
+		}
+		return filteredRecords, nil
+	})
+}
+
+// AppendRecords adds records to the zone, creating several of them in parallel.
+// It returns the records that were added. If adding a record fails, the records
+// that were added nonetheless are returned along with the error. The IDs of the
+// records are ignored: every record is created anew, e.g. when copying records
+// from another zone, and returned with the ID Linode assigned it. Use SetRecords
+// to change a record with a known ID.
+func (p *Provider) AppendRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	return withZone(ctx, p, zone, func(resolved resolvedZone) ([]libdns.Record, error) {
+		return p.appendRecords(ctx, resolved, records)
+	})
 }
 
 // SetRecords sets the records in the zone, either by updating existing records or creating new ones.
-// It returns the updated records.
+// Records without an ID update the existing record of the same name and type, if any.
+// Records that already exist as they are set are not updated. Afterwards, every other record of
+// the same name and type as one of the records is deleted, so that exactly the given records remain.
+// SPF records, which are stored as TXT records, only replace the TXT records holding an SPF policy.
+// Records with an ID are renamed if their name changed. A record renamed to the domain apex
+// gets a new ID, as Linode can only move records there by recreating them.
+// It returns the updated records as stored by Linode, with the same IDs GetRecords returns for them.
 func (p *Provider) SetRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
-	p.init(ctx)
-	domainID, err := p.getDomainIDByZone(ctx, zone)
-	if err != nil {
-		return nil, fmt.Errorf("could not find domain ID for zone: %s: %v", zone, err)
+	return withZone(ctx, p, zone, func(resolved resolvedZone) ([]libdns.Record, error) {
+		return p.setRecords(ctx, resolved, records)
+	})
+}
+
+// ChangeAction is the kind of a RecordChange.
+type ChangeAction string
+
+const (
+	// ChangeCreate creates a new record.
+	ChangeCreate ChangeAction = "create"
+	// ChangeUpdate updates an existing record.
+	ChangeUpdate ChangeAction = "update"
+	// ChangeNone leaves an existing record that is already as it is set.
+	ChangeNone ChangeAction = "none"
+	// ChangeDelete deletes an existing record of a name and type that is set.
+	ChangeDelete ChangeAction = "delete"
+)
+
+// RecordChange is a change SetRecords makes to a zone. Deletions follow the
+// creations and updates.
+type RecordChange struct {
+	Action ChangeAction
+	// Record is the record as it is set. Its ID is the one of the record
+	// it updates.
+	Record libdns.Record
+	// Existing is the record before an update, if it is known.
+	Existing libdns.Record
+}
+
+// String describes the change in a single line, e.g. for logging a plan.
+func (c RecordChange) String() string {
+	switch c.Action {
+	case ChangeCreate:
+		return fmt.Sprintf("create %s %s: %q", c.Record.Type, c.Record.Name, c.Record.Value)
+	case ChangeUpdate:
+		return fmt.Sprintf("update %s %s (ID %s): %q -> %q", c.Record.Type, c.Record.Name, c.Record.ID, c.Existing.Value, c.Record.Value)
+	case ChangeDelete:
+		return fmt.Sprintf("delete %s %s (ID %s): %q", c.Record.Type, c.Record.Name, c.Record.ID, c.Record.Value)
+	case ChangeNone:
+		return fmt.Sprintf("keep %s %s (ID %s): %q", c.Record.Type, c.Record.Name, c.Record.ID, c.Record.Value)
 	}
-	updatedRecords := make([]libdns.Record, 0, len(records))
-	for _, record := range records {
-		updatedRecord, err := p.createOrUpdateDomainRecord(ctx, zone, domainID, &record)
+	return fmt.Sprintf("%s %s %s", c.Action, c.Record.Type, c.Record.Name)
+}
+
+// RecordsEqual reports whether a and b are the same record as Linode stores
+// them, regardless of how they are written: their types and names are
+// compared ignoring case, "@" and the empty name both name the apex, values
+// with several fields, such as those of MX, SRV and CAA records, are compared
+// field by field, and TTLs are compared once snapped to the TTLs Linode
+// accepts. IDs are not compared. The names of both records must be relative
+// to the same zone, or both be fully qualified.
+func RecordsEqual(a, b libdns.Record) bool {
+	a, b = comparableRecord(a), comparableRecord(b)
+	return strings.EqualFold(a.Type, b.Type) && strings.EqualFold(a.Name, b.Name) && sameValue(a, b) && a.TTL == b.TTL
+}
+
+// EnsureRecord creates the record in the zone if there is no record of the
+// same name and type yet, and otherwise updates the existing one, preferring
+// one that already has the same value. It returns the record as stored by
+// Linode, without updating it if it is already up to date.
+func (p *Provider) EnsureRecord(ctx context.Context, zone string, record libdns.Record) (libdns.Record, error) {
+	return withZone(ctx, p, zone, func(resolved resolvedZone) (libdns.Record, error) {
+		ensuredRecord, err := p.ensureRecord(ctx, resolved, record)
+		if err != nil {
+			return libdns.Record{}, err
+		}
+		return *ensuredRecord, nil
+	})
+}
+
+// PlanRecords returns the changes SetRecords would make to set the records in
+// the zone, without making any of them. The records are matched against the
+// current records of the zone the same way SetRecords matches them.
+func (p *Provider) PlanRecords(ctx context.Context, zone string, records []libdns.Record) ([]RecordChange, error) {
+	return withZone(ctx, p, zone, func(resolved resolvedZone) ([]RecordChange, error) {
+		existingRecords, err := p.listDomainRecords(ctx, resolved)
 		if err != nil {
 			return nil, err
 		}
-		updatedRecords = append(updatedRecords, *updatedRecord)
-	}
-	return updatedRecords, nil
+		return p.planRecords(resolved, existingRecords, records), nil
+	})
 }
 
-// DeleteRecords deletes the records from the zone. It returns the records that were deleted.
+// DeleteRecords deletes the records from the zone, deleting several of them in parallel.
+// Records without an ID delete every record of the same name, and of the same type and value
+// if those are given. Records with neither an ID, a name nor a type are rejected, so that an empty
+// record does not delete the apex; name the apex "@" to delete its records. It returns the records that were deleted. If deleting some records
+// fails, the others are deleted nonetheless and returned along with the joined errors. In a zone below
+// its Linode domain, records given by ID that are outside of the zone fail with ErrRecordNotFound.
 func (p *Provider) DeleteRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
-	p.init(ctx)
-	domainID, err := p.getDomainIDByZone(ctx, zone)
-	if err != nil {
-		return nil, fmt.Errorf("could not find domain ID for zone: %s: %v", zone, err)
+	return withZone(ctx, p, zone, func(resolved resolvedZone) ([]libdns.Record, error) {
+		return p.deleteRecords(ctx, resolved, records)
+	})
+}
+
+// ApplyChanges appends, sets and then deletes records in the zone, looking up
+// the zone only once. It returns the records that were appended, set and
+// deleted; if a step fails, the following steps are not performed. If the
+// domain of the zone turns out to be stale, all three steps are repeated with
+// the zone resolved anew.
+func (p *Provider) ApplyChanges(ctx context.Context, zone string, appends, sets, deletes []libdns.Record) (appended, set, deleted []libdns.Record, err error) {
+	changes, err := withZone(ctx, p, zone, func(resolved resolvedZone) (appliedChanges, error) {
+		return p.applyChanges(ctx, resolved, appends, sets, deletes)
+	})
+	return changes.appended, changes.set, changes.deleted, err
+}
+
+// DeleteAllRecords deletes every record in the zone, except for the SOA and NS
+// records that Linode manages itself, deleting several of them in parallel.
+// It returns the records that were deleted, along with the joined errors of
+// the records that could not be deleted.
+func (p *Provider) DeleteAllRecords(ctx context.Context, zone string) ([]libdns.Record, error) {
+	return withZone(ctx, p, zone, func(resolved resolvedZone) ([]libdns.Record, error) {
+		existingRecords, err := p.listDomainRecords(ctx, resolved)
+		if err != nil {
+			return nil, err
+		}
+		unmanagedRecords := make([]libdns.Record, 0, len(existingRecords))
+		for _, record := range existingRecords {
+			if !isManagedRecord(resolved, record) {
+				unmanagedRecords = append(unmanagedRecords, record)
+			}
+		}
+		return p.deleteDeletableRecords(ctx, resolved, unmanagedRecords, nil)
+	})
+}
+
+// ZoneSettings are the SOA parameters of a zone. Linode snaps the durations
+// to the same values it accepts as record TTLs.
+type ZoneSettings struct {
+	// SOAEmail is the email address of the zone's administrator.
+	SOAEmail string
+	// TTL is the default TTL of the zone's records.
+	TTL time.Duration
+	// Refresh is how often secondary name servers refresh the zone.
+	Refresh time.Duration
+	// Retry is how long secondary name servers wait to retry a failed refresh.
+	Retry time.Duration
+	// Expire is how long secondary name servers keep serving the zone without a refresh.
+	Expire time.Duration
+}
+
+// GetZoneSettings returns the SOA parameters of the zone.
+func (p *Provider) GetZoneSettings(ctx context.Context, zone string) (ZoneSettings, error) {
+	return withZone(ctx, p, zone, func(resolved resolvedZone) (ZoneSettings, error) {
+		domain, err := p.getDomain(ctx, resolved.domainID)
+		if err != nil {
+			return ZoneSettings{}, err
+		}
+		return convertToZoneSettings(domain), nil
+	})
+}
+
+// GetZoneTTL returns the TTL that the records of the zone stored without a TTL
+// of their own have: the default TTL of its Linode domain, or 24 hours if the
+// domain has none set.
+func (p *Provider) GetZoneTTL(ctx context.Context, zone string) (time.Duration, error) {
+	return withZone(ctx, p, zone, func(resolved resolvedZone) (time.Duration, error) {
+		domain, err := p.getDomain(ctx, resolved.domainID)
+		if err != nil {
+			return 0, err
+		}
+		return newResolvedZone(zone, domain).defaultTTL, nil
+	})
+}
+
+// SetZoneSettings updates the SOA parameters of the zone. Zero fields are
+// left unchanged. It returns the settings as stored by Linode.
+func (p *Provider) SetZoneSettings(ctx context.Context, zone string, settings ZoneSettings) (ZoneSettings, error) {
+	return withZone(ctx, p, zone, func(resolved resolvedZone) (ZoneSettings, error) {
+		domain, err := p.getDomain(ctx, resolved.domainID)
+		if err != nil {
+			return ZoneSettings{}, err
+		}
+		options := domain.GetUpdateOptions()
+		if settings.SOAEmail != "" {
+			options.SOAEmail = settings.SOAEmail
+		}
+		if settings.TTL != 0 {
+			options.TTLSec = snapTTL(settings.TTL)
+		}
+		if settings.Refresh != 0 {
+			options.RefreshSec = snapTTL(settings.Refresh)
+		}
+		if settings.Retry != 0 {
+			options.RetrySec = snapTTL(settings.Retry)
+		}
+		if settings.Expire != 0 {
+			options.ExpireSec = snapTTL(settings.Expire)
+		}
+		domain, err = p.updateDomain(ctx, resolved.domainID, options)
+		if err != nil {
+			return ZoneSettings{}, err
+		}
+		return convertToZoneSettings(domain), nil
+	})
+}
+
+// Zone is a DNS zone managed by Linode. It mirrors the zone type of newer
+// libdns releases.
+type Zone struct {
+	Name string
+}
+
+// ListZones lists all the zones, i.e. Linode domains, of the account.
+func (p *Provider) ListZones(ctx context.Context) ([]Zone, error) {
+	return p.ListZonesFiltered(ctx, ZoneFilter{})
+}
+
+// ZoneFilter constrains the zones returned by ListZonesFiltered. Empty fields
+// match any zone.
+type ZoneFilter struct {
+	// NameContains is a substring of the zone name, ignoring case. A
+	// leading "*" is dropped, so that the zones below prod.example.com can
+	// be listed with "*.prod.example.com" as well as ".prod.example.com";
+	// other wildcards are matched as they are.
+	NameContains string
+	// Tag is a tag the Linode domain carries.
+	Tag string
+}
+
+// ListZonesFiltered lists the zones of the account that match filter. The
+// zones are filtered by the Linode API, so that only the matching ones are
+// retrieved.
+func (p *Provider) ListZonesFiltered(ctx context.Context, filter ZoneFilter) ([]Zone, error) {
+	if err := p.init(); err != nil {
+		return nil, err
 	}
-	deletedRecords := make([]libdns.Record, 0, len(records))
-	for _, record := range records {
-		err := p.deleteDomainRecord(ctx, domainID, &record)
+	f := linodego.Filter{}
+	if nameContains := strings.TrimPrefix(filter.NameContains, "*"); nameContains != "" {
+		f.AddField(linodego.Contains, "domain", strings.ToLower(normalizeZone(nameContains)))
+	}
+	if filter.Tag != "" {
+		f.AddField(linodego.Eq, "tags", filter.Tag)
+	}
+	var apiFilter string
+	if len(f.Children) > 0 {
+		marshaledFilter, err := f.MarshalJSON()
 		if err != nil {
 			return nil, err
 		}
-		deletedRecords = append(deletedRecords, record)
+		apiFilter = string(marshaledFilter)
+	}
+	domains, err := p.listDomains(ctx, apiFilter)
+	if err != nil {
+		return nil, err
+	}
+	zones := make([]Zone, 0, len(domains))
+	for _, domain := range domains {
+		zones = append(zones, Zone{Name: domain.Domain + "."})
+	}
+	return zones, nil
+}
+
+// Reconfigure rebuilds the Linode client from the current field values, e.g.
+// after rotating APIToken or moving to another APIURL in a long-running
+// process, and empties the zone cache. The current MaxConcurrency applies to
+// the requests sent from then on. Providers returned by WithToken before are
+// not reconfigured; WithToken returns new ones from then on. Calls in flight
+// finish with the previous client. An error configuring the new client is
+// returned by every later call as well.
+func (p *Provider) Reconfigure() error {
+	client, err := p.newClient()
+	p.clientMutex.Lock()
+	p.client, p.initErr = client, err
+	p.clientMutex.Unlock()
+	p.cacheMutex.Lock()
+	p.zoneCache = nil
+	p.cacheMutex.Unlock()
+	p.mutex.Lock()
+	p.tokenScoped = nil
+	p.requestSlots = nil
+	p.mutex.Unlock()
+	return err
+}
+
+// Clone returns a provider configured like this one, e.g. to target another
+// APIURL or APIVersion for some operations without restarting. The clone sets
+// up its own Linode client on first use and starts with an empty zone cache,
+// unless this provider was created by WithClient: the clone then sends its
+// requests through the same client.
+func (p *Provider) Clone() *Provider {
+	return &Provider{
+		injected:              p.injected,
+		APIToken:              p.APIToken,
+		GetToken:              p.GetToken,
+		TokenEnvVar:           p.TokenEnvVar,
+		HTTPClient:            p.HTTPClient,
+		APIURL:                p.APIURL,
+		APIVersion:            p.APIVersion,
+		UserAgent:             p.UserAgent,
+		ZoneCacheTTL:          p.ZoneCacheTTL,
+		DisableAPICache:       p.DisableAPICache,
+		AutoCreateZone:        p.AutoCreateZone,
+		SOAEmail:              p.SOAEmail,
+		DomainType:            p.DomainType,
+		MasterIPs:             p.MasterIPs,
+		DomainTags:            p.DomainTags,
+		DefaultTTL:            p.DefaultTTL,
+		MinTTL:                p.MinTTL,
+		MaxRetries:            p.MaxRetries,
+		RetryBaseDelay:        p.RetryBaseDelay,
+		RetryMaxDelay:         p.RetryMaxDelay,
+		RetryNonIdempotent:    p.RetryNonIdempotent,
+		PageSize:              p.PageSize,
+		MaxConcurrency:        p.MaxConcurrency,
+		SkipExisting:          p.SkipExisting,
+		RequestTimeout:        p.RequestTimeout,
+		ListTimeout:           p.ListTimeout,
+		MutateTimeout:         p.MutateTimeout,
+		IgnoreMissingRecords:  p.IgnoreMissingRecords,
+		AbsoluteNames:         p.AbsoluteNames,
+		IncludeManagedRecords: p.IncludeManagedRecords,
+		Debug:                 p.Debug,
+		Logger:                p.Logger,
+		Tracer:                p.Tracer,
+		Metrics:               p.Metrics,
 	}
-	return deletedRecords, nil
+}
+
+// WithToken returns a provider configured like this one that authenticates
+// with token instead, e.g. to manage the zones of another Linode account. The
+// provider is created once per token and then reused, so that its client and
+// zone cache are kept across calls.
+func (p *Provider) WithToken(token string) *Provider {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if provider, ok := p.tokenScoped[token]; ok {
+		return provider
+	}
+	provider := p.Clone()
+	provider.APIToken = token
+	provider.GetToken = nil
+	if p.tokenScoped == nil {
+		p.tokenScoped = make(map[string]*Provider)
+	}
+	p.tokenScoped[token] = provider
+	return provider
+}
+
+// WithClient returns a provider configured like this one that sends its
+// requests through client instead of a Linode client of its own, e.g. a fake
+// of the Linode API in tests. The fields configuring the Linode client, such
+// as APIToken and APIURL, have no effect on it.
+func (p *Provider) WithClient(client Client) *Provider {
+	provider := p.Clone()
+	provider.injected = client
+	return provider
 }
 
 // Interface guards
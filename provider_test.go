@@ -0,0 +1,880 @@
+package linode
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/linode/linodego"
+)
+
+// fakeClient is an in-memory stand-in for the Linode API. It ignores list
+// filters and answers every list request with a single page.
+type fakeClient struct {
+	mutex   sync.Mutex
+	domains []linodego.Domain
+	records map[int][]linodego.DomainRecord
+	nextID  int
+	calls   map[string]int
+}
+
+// newFakeProvider returns a provider using a fake client with a master
+// domain for each of domains.
+func newFakeProvider(domains ...string) (*Provider, *fakeClient) {
+	client := &fakeClient{records: make(map[int][]linodego.DomainRecord), nextID: 1000, calls: make(map[string]int)}
+	for _, domain := range domains {
+		client.addDomain(domain)
+	}
+	return (&Provider{}).WithClient(client), client
+}
+
+func (c *fakeClient) addDomain(name string) *linodego.Domain {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.nextID++
+	c.domains = append(c.domains, linodego.Domain{ID: c.nextID, Domain: name, Type: linodego.DomainTypeMaster, Status: linodego.DomainStatusActive})
+	return &c.domains[len(c.domains)-1]
+}
+
+// addRecord stores record in the domain named domain and returns its ID.
+func (c *fakeClient) addRecord(domain string, record linodego.DomainRecord) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, d := range c.domains {
+		if d.Domain == domain {
+			c.nextID++
+			record.ID = c.nextID
+			c.records[d.ID] = append(c.records[d.ID], record)
+			return record.ID
+		}
+	}
+	panic("no domain " + domain)
+}
+
+// domainRecords returns the records stored in the domain named domain.
+func (c *fakeClient) domainRecords(domain string) []linodego.DomainRecord {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, d := range c.domains {
+		if d.Domain == domain {
+			return append([]linodego.DomainRecord(nil), c.records[d.ID]...)
+		}
+	}
+	return nil
+}
+
+func (c *fakeClient) callCount(method string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.calls[method]
+}
+
+func (c *fakeClient) call(method string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.calls[method]++
+}
+
+func notFound() error {
+	return &linodego.Error{Code: http.StatusNotFound, Message: "Not found"}
+}
+
+func setPage(opts *linodego.ListOptions, results int) {
+	if opts != nil {
+		opts.PageOptions = &linodego.PageOptions{Page: 1, Pages: 1, Results: results}
+	}
+}
+
+func (c *fakeClient) domainIndex(domainID int) int {
+	for i, domain := range c.domains {
+		if domain.ID == domainID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *fakeClient) recordIndex(domainID, recordID int) int {
+	for i, record := range c.records[domainID] {
+		if record.ID == recordID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *fakeClient) GetProfile(ctx context.Context) (*linodego.Profile, error) {
+	c.call("GetProfile")
+	return &linodego.Profile{Username: "user"}, nil
+}
+
+func (c *fakeClient) ListDomains(ctx context.Context, opts *linodego.ListOptions) ([]linodego.Domain, error) {
+	c.call("ListDomains")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	setPage(opts, len(c.domains))
+	return append([]linodego.Domain(nil), c.domains...), nil
+}
+
+func (c *fakeClient) GetDomain(ctx context.Context, domainID int) (*linodego.Domain, error) {
+	c.call("GetDomain")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	i := c.domainIndex(domainID)
+	if i < 0 {
+		return nil, notFound()
+	}
+	domain := c.domains[i]
+	return &domain, nil
+}
+
+func (c *fakeClient) CreateDomain(ctx context.Context, opts linodego.DomainCreateOptions) (*linodego.Domain, error) {
+	c.call("CreateDomain")
+	domain := c.addDomain(opts.Domain)
+	return domain, nil
+}
+
+func (c *fakeClient) UpdateDomain(ctx context.Context, domainID int, opts linodego.DomainUpdateOptions) (*linodego.Domain, error) {
+	c.call("UpdateDomain")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	i := c.domainIndex(domainID)
+	if i < 0 {
+		return nil, notFound()
+	}
+	if opts.TTLSec != 0 {
+		c.domains[i].TTLSec = opts.TTLSec
+	}
+	domain := c.domains[i]
+	return &domain, nil
+}
+
+func (c *fakeClient) ListDomainRecords(ctx context.Context, domainID int, opts *linodego.ListOptions) ([]linodego.DomainRecord, error) {
+	c.call("ListDomainRecords")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.domainIndex(domainID) < 0 {
+		return nil, notFound()
+	}
+	setPage(opts, len(c.records[domainID]))
+	return append([]linodego.DomainRecord(nil), c.records[domainID]...), nil
+}
+
+func (c *fakeClient) GetDomainRecord(ctx context.Context, domainID int, recordID int) (*linodego.DomainRecord, error) {
+	c.call("GetDomainRecord")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	i := c.recordIndex(domainID, recordID)
+	if i < 0 {
+		return nil, notFound()
+	}
+	record := c.records[domainID][i]
+	return &record, nil
+}
+
+func (c *fakeClient) CreateDomainRecord(ctx context.Context, domainID int, opts linodego.DomainRecordCreateOptions) (*linodego.DomainRecord, error) {
+	c.call("CreateDomainRecord")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.domainIndex(domainID) < 0 {
+		return nil, notFound()
+	}
+	c.nextID++
+	record := linodego.DomainRecord{ID: c.nextID}
+	applyRecordOptions(&record, linodego.DomainRecordUpdateOptions(opts))
+	record.Type = opts.Type
+	record.Name = opts.Name
+	record.Target = opts.Target
+	c.records[domainID] = append(c.records[domainID], record)
+	return &record, nil
+}
+
+func (c *fakeClient) UpdateDomainRecord(ctx context.Context, domainID int, recordID int, opts linodego.DomainRecordUpdateOptions) (*linodego.DomainRecord, error) {
+	c.call("UpdateDomainRecord")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	i := c.recordIndex(domainID, recordID)
+	if i < 0 {
+		return nil, notFound()
+	}
+	record := &c.records[domainID][i]
+	applyRecordOptions(record, opts)
+	updated := *record
+	return &updated, nil
+}
+
+func (c *fakeClient) DeleteDomainRecord(ctx context.Context, domainID int, recordID int) error {
+	c.call("DeleteDomainRecord")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	i := c.recordIndex(domainID, recordID)
+	if i < 0 {
+		return notFound()
+	}
+	c.records[domainID] = append(c.records[domainID][:i], c.records[domainID][i+1:]...)
+	return nil
+}
+
+// applyRecordOptions sets the fields of record that opts sets, leaving the
+// ones it omits as they are, like Linode does for updates.
+func applyRecordOptions(record *linodego.DomainRecord, opts linodego.DomainRecordUpdateOptions) {
+	if opts.Type != "" {
+		record.Type = opts.Type
+	}
+	if opts.Name != "" {
+		record.Name = opts.Name
+	}
+	if opts.Target != "" {
+		record.Target = opts.Target
+	}
+	if opts.Priority != nil {
+		record.Priority = *opts.Priority
+	}
+	if opts.Weight != nil {
+		record.Weight = *opts.Weight
+	}
+	if opts.Port != nil {
+		record.Port = *opts.Port
+	}
+	if opts.Service != nil {
+		record.Service = opts.Service
+	}
+	if opts.Protocol != nil {
+		record.Protocol = opts.Protocol
+	}
+	if opts.TTLSec != 0 {
+		record.TTLSec = opts.TTLSec
+	}
+	if opts.Tag != nil {
+		record.Tag = opts.Tag
+	}
+}
+
+func TestSetRecordsWithoutTTLConverges(t *testing.T) {
+	p, client := newFakeProvider("example.com")
+	id := client.addRecord("example.com", linodego.DomainRecord{Type: "A", Name: "www", Target: "192.0.2.1", TTLSec: 3600})
+	record := libdns.Record{ID: strconv.Itoa(id), Type: "A", Name: "www", Value: "192.0.2.1"}
+	for i := 0; i < 2; i++ {
+		records, err := p.SetRecords(context.Background(), "example.com.", []libdns.Record{record})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 || records[0].TTL != time.Hour {
+			t.Fatalf("got records %+v, want the record with its TTL of 1h", records)
+		}
+	}
+	if got := client.callCount("UpdateDomainRecord"); got != 0 {
+		t.Errorf("got %d updates, want none for a record without a TTL and the same value", got)
+	}
+
+	record.Value = "192.0.2.2"
+	for i := 0; i < 2; i++ {
+		if _, err := p.SetRecords(context.Background(), "example.com.", []libdns.Record{record}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := client.callCount("UpdateDomainRecord"); got != 1 {
+		t.Errorf("got %d updates, want 1 for the changed value", got)
+	}
+	if records := client.domainRecords("example.com"); len(records) != 1 || records[0].Target != "192.0.2.2" || records[0].TTLSec != 3600 {
+		t.Errorf("got stored records %+v, want the new value with the TTL kept", records)
+	}
+}
+
+func TestClonesKeepTheClient(t *testing.T) {
+	p, client := newFakeProvider("example.com")
+	for name, provider := range map[string]*Provider{
+		"Clone":     p.Clone(),
+		"WithToken": p.WithToken("other"),
+	} {
+		before := client.callCount("ListDomains")
+		if _, err := provider.GetRecords(context.Background(), "example.com."); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if client.callCount("ListDomains") == before {
+			t.Errorf("%s: the provider did not use the client given to WithClient", name)
+		}
+	}
+}
+
+// recreateDomain gives the domain named name a new ID and no records, as if
+// it was deleted and created again.
+func (c *fakeClient) recreateDomain(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, domain := range c.domains {
+		if domain.Domain == name {
+			delete(c.records, domain.ID)
+			c.nextID++
+			c.domains[i].ID = c.nextID
+		}
+	}
+}
+
+func TestStaleZoneIsRefreshed(t *testing.T) {
+	p, client := newFakeProvider("example.com")
+	p.ZoneCacheTTL = time.Hour
+	if _, err := p.GetRecords(context.Background(), "example.com."); err != nil {
+		t.Fatal(err)
+	}
+	client.recreateDomain("example.com")
+	set := []libdns.Record{{Type: "A", Name: "www", Value: "192.0.2.1"}}
+	deletes := []libdns.Record{{Type: "A", Name: "old"}}
+	_, gotSet, _, err := p.ApplyChanges(context.Background(), "example.com.", nil, set, deletes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotSet) != 1 || len(client.domainRecords("example.com")) != 1 {
+		t.Errorf("got set records %+v, want the record set in the recreated domain", gotSet)
+	}
+	if got := client.callCount("ListDomains"); got != 2 {
+		t.Errorf("got %d domain lookups, want 2", got)
+	}
+}
+
+func TestMissingRecordDoesNotRefreshZone(t *testing.T) {
+	p, client := newFakeProvider("example.com")
+	p.ZoneCacheTTL = time.Hour
+	for i := 0; i < 2; i++ {
+		_, err := p.GetRecord(context.Background(), "example.com.", "12345")
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("got error %v, want ErrRecordNotFound", err)
+		}
+		if errors.Is(err, ErrZoneNotFound) {
+			t.Fatalf("got error %v, want no ErrZoneNotFound for a missing record", err)
+		}
+	}
+	if got := client.callCount("ListDomains"); got != 1 {
+		t.Errorf("got %d domain lookups, want 1", got)
+	}
+}
+
+func TestZonesOfTheSameDomainAreLockedTogether(t *testing.T) {
+	p, _ := newFakeProvider("example.com")
+	ctx := context.Background()
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		_, _ = withZone(ctx, p, "example.com.", func(resolved resolvedZone) (struct{}, error) {
+			close(entered)
+			<-release
+			return struct{}{}, nil
+		})
+	}()
+	<-entered
+	done := make(chan error)
+	go func() {
+		_, err := p.GetRecords(ctx, "sub.example.com.")
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("sub.example.com was listed while example.com was locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetRecordsReturnsTheIDsGetRecordsReturns(t *testing.T) {
+	p, client := newFakeProvider("example.com")
+	client.addRecord("example.com", linodego.DomainRecord{Type: "A", Name: "www", Target: "192.0.2.1", TTLSec: 3600})
+	client.addRecord("example.com", linodego.DomainRecord{Type: "TXT", Name: "", Target: "v=spf1 -all", TTLSec: 3600})
+	set, err := p.SetRecords(context.Background(), "example.com.", []libdns.Record{
+		{Type: "A", Name: "www", Value: "192.0.2.2"},
+		{Type: "TXT", Name: "@", Value: "v=spf1 -all", TTL: time.Hour},
+		{Type: "MX", Name: "@", Value: "10 mail.example.com."},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := p.GetRecords(context.Background(), "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]libdns.Record)
+	for _, record := range records {
+		ids[record.ID] = record
+	}
+	for _, record := range set {
+		got, ok := ids[record.ID]
+		if !ok {
+			t.Errorf("SetRecords returned %+v, whose ID GetRecords does not return", record)
+			continue
+		}
+		if got != record {
+			t.Errorf("SetRecords returned %+v, GetRecords %+v", record, got)
+		}
+	}
+	if len(set) != 3 || len(records) != 3 {
+		t.Errorf("got %d records set and %d listed, want 3 each", len(set), len(records))
+	}
+}
+
+// testRecordLifecycle creates, reads, updates and deletes an A record named
+// name in the zone, checking that Linode stores it as linodeName and that it
+// is returned as wantName.
+func testRecordLifecycle(t *testing.T, zone, name, linodeName, wantName string) {
+	t.Helper()
+	p, client := newFakeProvider("example.com")
+	ctx := context.Background()
+	storedName := func() string {
+		records := client.domainRecords("example.com")
+		if len(records) != 1 {
+			t.Fatalf("%s in %s: got stored records %+v, want one", name, zone, records)
+		}
+		return records[0].Name
+	}
+
+	appended, err := p.AppendRecords(ctx, zone, []libdns.Record{{Type: "A", Name: name, Value: "192.0.2.1"}})
+	if err != nil {
+		t.Fatalf("%s in %s: %v", name, zone, err)
+	}
+	if got := storedName(); got != linodeName {
+		t.Errorf("%s in %s: created as %q, want %q", name, zone, got, linodeName)
+	}
+	if appended[0].Name != wantName {
+		t.Errorf("%s in %s: AppendRecords returned the name %q, want %q", name, zone, appended[0].Name, wantName)
+	}
+
+	records, err := p.GetRecords(ctx, zone)
+	if err != nil {
+		t.Fatalf("%s in %s: %v", name, zone, err)
+	}
+	if len(records) != 1 || records[0].Name != wantName {
+		t.Errorf("%s in %s: GetRecords returned %+v, want the name %q", name, zone, records, wantName)
+	}
+
+	updated := appended[0]
+	updated.Value = "192.0.2.2"
+	set, err := p.SetRecords(ctx, zone, []libdns.Record{updated})
+	if err != nil {
+		t.Fatalf("%s in %s: %v", name, zone, err)
+	}
+	if got := storedName(); got != linodeName {
+		t.Errorf("%s in %s: updated to %q, want %q", name, zone, got, linodeName)
+	}
+	if len(set) != 1 || set[0].Name != wantName || set[0].Value != "192.0.2.2" {
+		t.Errorf("%s in %s: SetRecords returned %+v, want the name %q", name, zone, set, wantName)
+	}
+
+	deleted, err := p.DeleteRecords(ctx, zone, []libdns.Record{{Type: "A", Name: name}})
+	if err != nil {
+		t.Fatalf("%s in %s: %v", name, zone, err)
+	}
+	if len(deleted) != 1 || len(client.domainRecords("example.com")) != 0 {
+		t.Errorf("%s in %s: deleted %+v, want the record deleted", name, zone, deleted)
+	}
+}
+
+func TestSubdomainRecordNames(t *testing.T) {
+	for _, test := range []struct {
+		zone, name, linodeName, wantName string
+	}{
+		{"example.com.", "sub", "sub", "sub"},
+		{"example.com.", "sub.example.com.", "sub", "sub"},
+		{"example.com.", "a.sub", "a.sub", "a.sub"},
+		{"example.com.", "a.sub.example.com.", "a.sub", "a.sub"},
+		{"sub.example.com.", "www", "www.sub", "www"},
+		{"sub.example.com.", "www.sub.example.com.", "www.sub", "www"},
+		{"sub.example.com.", "@", "sub", "@"},
+	} {
+		testRecordLifecycle(t, test.zone, test.name, test.linodeName, test.wantName)
+	}
+}
+
+func TestApexAndWildcardRecordNames(t *testing.T) {
+	for _, test := range []struct {
+		zone, name, linodeName, wantName string
+	}{
+		{"example.com.", "@", "", "@"},
+		{"example.com.", "example.com.", "", "@"},
+		{"example.com.", "*", "*", "*"},
+		{"example.com.", "*.example.com.", "*", "*"},
+		{"example.com.", "*.sub", "*.sub", "*.sub"},
+		{"sub.example.com.", "*", "*.sub", "*"},
+		{"sub.example.com.", "*.sub.example.com.", "*.sub", "*"},
+	} {
+		testRecordLifecycle(t, test.zone, test.name, test.linodeName, test.wantName)
+	}
+}
+
+func TestMisplacedWildcardIsRejected(t *testing.T) {
+	p, client := newFakeProvider("example.com")
+	_, err := p.AppendRecords(context.Background(), "example.com.", []libdns.Record{{Type: "A", Name: "www.*", Value: "192.0.2.1"}})
+	if err == nil {
+		t.Error("got no error for a wildcard that is not the leftmost label")
+	}
+	if got := client.callCount("CreateDomainRecord"); got != 0 {
+		t.Errorf("got %d requests to create the record, want none", got)
+	}
+}
+
+func TestAppendRecordsKeepsEachRecordsData(t *testing.T) {
+	p, client := newFakeProvider("example.com")
+	var records []libdns.Record
+	for i := 0; i < 20; i++ {
+		records = append(records, libdns.Record{Type: "TXT", Name: "record" + strconv.Itoa(i), Value: "value" + strconv.Itoa(i)})
+	}
+	original := append([]libdns.Record(nil), records...)
+	appended, err := p.AppendRecords(context.Background(), "example.com.", records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(appended) != len(records) {
+		t.Fatalf("got %d records appended, want %d", len(appended), len(records))
+	}
+	for i, record := range appended {
+		if record.Name != original[i].Name || record.Value != original[i].Value {
+			t.Errorf("record %d: got %s %q, want %s %q", i, record.Name, record.Value, original[i].Name, original[i].Value)
+		}
+	}
+	stored := make(map[string]string)
+	for _, record := range client.domainRecords("example.com") {
+		stored[record.Name] = record.Target
+	}
+	for _, record := range original {
+		if stored[record.Name] != record.Value {
+			t.Errorf("got %s stored with %q, want %q", record.Name, stored[record.Name], record.Value)
+		}
+	}
+	for i := range records {
+		if records[i] != original[i] {
+			t.Errorf("record %d was changed to %+v", i, records[i])
+		}
+	}
+}
+
+func TestRenameRecords(t *testing.T) {
+	for _, test := range []struct {
+		linodeName, newName, newLinodeName string
+		keepsID                            bool
+	}{
+		{"www", "web", "web", true},
+		{"www", "a.b", "a.b", true},
+		{"", "www", "www", true},
+		{"www", "@", "", false},
+	} {
+		p, client := newFakeProvider("example.com")
+		id := client.addRecord("example.com", linodego.DomainRecord{Type: "A", Name: test.linodeName, Target: "192.0.2.1", TTLSec: 3600})
+		set, err := p.SetRecords(context.Background(), "example.com.", []libdns.Record{{ID: strconv.Itoa(id), Type: "A", Name: test.newName, Value: "192.0.2.1"}})
+		if err != nil {
+			t.Fatalf("%q to %q: %v", test.linodeName, test.newName, err)
+		}
+		stored := client.domainRecords("example.com")
+		if len(stored) != 1 || stored[0].Name != test.newLinodeName {
+			t.Fatalf("%q to %q: got stored records %+v, want a single record named %q", test.linodeName, test.newName, stored, test.newLinodeName)
+		}
+		if len(set) != 1 || set[0].Name != test.newName || set[0].ID != strconv.Itoa(stored[0].ID) {
+			t.Errorf("%q to %q: SetRecords returned %+v, want the stored record named %q", test.linodeName, test.newName, set, test.newName)
+		}
+		if keptID := stored[0].ID == id; keptID != test.keepsID {
+			t.Errorf("%q to %q: the record kept its ID: %t, want %t", test.linodeName, test.newName, keptID, test.keepsID)
+		}
+	}
+}
+
+func TestEmptyZoneAndMissingZone(t *testing.T) {
+	p, _ := newFakeProvider("example.com")
+	records, err := p.GetRecords(context.Background(), "example.com.")
+	if err != nil {
+		t.Fatalf("empty zone: %v", err)
+	}
+	if records == nil || len(records) != 0 {
+		t.Errorf("empty zone: got records %#v, want an empty, non-nil slice", records)
+	}
+
+	records, err = p.GetRecords(context.Background(), "example.net.")
+	if !errors.Is(err, ErrZoneNotFound) {
+		t.Errorf("missing zone: got error %v, want ErrZoneNotFound", err)
+	}
+	if err != nil && strings.Count(err.Error(), "example.net") != 1 {
+		t.Errorf("missing zone: got error %q, want it to name the zone once", err)
+	}
+	if records != nil {
+		t.Errorf("missing zone: got records %#v, want none", records)
+	}
+}
+
+func TestZoneWithOnlyManagedRecordsIsEmpty(t *testing.T) {
+	p, client := newFakeProvider("example.com")
+	client.addRecord("example.com", linodego.DomainRecord{Type: "NS", Name: "", Target: "ns1.linode.com"})
+	records, err := p.GetRecords(context.Background(), "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records == nil || len(records) != 0 {
+		t.Errorf("got records %#v, want an empty, non-nil slice", records)
+	}
+}
+
+func TestSetSPFRecordsKeepsOtherTXTRecords(t *testing.T) {
+	p, client := newFakeProvider("example.com")
+	client.addRecord("example.com", linodego.DomainRecord{Type: "TXT", Name: "", Target: "v=spf1 include:old.example.net -all"})
+	client.addRecord("example.com", linodego.DomainRecord{Type: "TXT", Name: "", Target: "google-site-verification=abc"})
+	client.addRecord("example.com", linodego.DomainRecord{Type: "TXT", Name: "", Target: "v=spf10 is not a policy"})
+	if _, err := p.SetRecords(context.Background(), "example.com.", []libdns.Record{{Type: "SPF", Name: "@", Value: "v=spf1 -all"}}); err != nil {
+		t.Fatal(err)
+	}
+	targets := make(map[string]bool)
+	for _, record := range client.domainRecords("example.com") {
+		targets[record.Target] = true
+	}
+	want := map[string]bool{"v=spf1 -all": true, "google-site-verification=abc": true, "v=spf10 is not a policy": true}
+	if len(targets) != len(want) {
+		t.Errorf("got TXT records %v, want %v", targets, want)
+	}
+	for target := range want {
+		if !targets[target] {
+			t.Errorf("got TXT records %v, want %q among them", targets, target)
+		}
+	}
+
+	if _, err := p.SetRecords(context.Background(), "example.com.", []libdns.Record{{Type: "TXT", Name: "@", Value: "only"}}); err != nil {
+		t.Fatal(err)
+	}
+	if records := client.domainRecords("example.com"); len(records) != 1 || records[0].Target != "only" {
+		t.Errorf("got records %+v, want TXT records to replace every TXT record", records)
+	}
+}
+
+func TestDeleteByIDStaysInSubdomainZone(t *testing.T) {
+	p, client := newFakeProvider("example.com")
+	outside := client.addRecord("example.com", linodego.DomainRecord{Type: "A", Name: "www", Target: "192.0.2.1"})
+	inside := client.addRecord("example.com", linodego.DomainRecord{Type: "A", Name: "www.sub", Target: "192.0.2.2"})
+	deleted, err := p.DeleteRecords(context.Background(), "sub.example.com.", []libdns.Record{{ID: strconv.Itoa(outside)}})
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v, want ErrRecordNotFound for a record outside of the zone", err)
+	}
+	if len(deleted) != 0 || len(client.domainRecords("example.com")) != 2 {
+		t.Errorf("deleted %+v, want the record of example.com kept", deleted)
+	}
+
+	p.IgnoreMissingRecords = true
+	if _, err := p.DeleteRecords(context.Background(), "sub.example.com.", []libdns.Record{{ID: strconv.Itoa(outside)}}); err != nil {
+		t.Errorf("got error %v with IgnoreMissingRecords", err)
+	}
+	if len(client.domainRecords("example.com")) != 2 {
+		t.Error("the record of example.com was deleted with IgnoreMissingRecords")
+	}
+
+	deleted, err = p.DeleteRecords(context.Background(), "sub.example.com.", []libdns.Record{{ID: strconv.Itoa(inside)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := client.domainRecords("example.com"); len(deleted) != 1 || len(records) != 1 || records[0].ID != outside {
+		t.Errorf("deleted %+v, leaving %+v, want the record of the zone deleted", deleted, records)
+	}
+}
+
+func TestDeleteEmptyRecordIsRejected(t *testing.T) {
+	p, client := newFakeProvider("example.com")
+	client.addRecord("example.com", linodego.DomainRecord{Type: "A", Name: "", Target: "192.0.2.1"})
+	client.addRecord("example.com", linodego.DomainRecord{Type: "MX", Name: "", Target: "mail.example.com", Priority: 10})
+	for _, records := range [][]libdns.Record{{{}}, {{Value: "192.0.2.1"}}, {{Type: "A", Name: "@"}, {}}} {
+		deleted, err := p.DeleteRecords(context.Background(), "example.com.", records)
+		if err == nil {
+			t.Errorf("deleting %+v: got no error", records)
+		}
+		if len(deleted) != 0 || len(client.domainRecords("example.com")) != 2 {
+			t.Fatalf("deleting %+v: deleted %+v, want nothing deleted", records, deleted)
+		}
+	}
+	deleted, err := p.DeleteRecords(context.Background(), "example.com.", []libdns.Record{{Name: "@"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 {
+		t.Errorf("got %+v deleted, want both apex records", deleted)
+	}
+}
+
+func TestExportZoneRoundTrip(t *testing.T) {
+	p, client := newFakeProvider("example.com")
+	client.domains[0].SOAEmail = "first.last@example.com"
+	client.domains[0].RefreshSec = 3600
+	client.addRecord("example.com", linodego.DomainRecord{Type: "NS", Name: "", Target: "ns1.linode.com"})
+	if _, err := p.AppendRecords(context.Background(), "example.com.", []libdns.Record{
+		{Type: "MX", Name: "@", Value: "10 mail.example.com", TTL: time.Hour},
+		{Type: "SRV", Name: "_sip._tcp", Value: "10 5 5060 sip.example.com", TTL: time.Hour},
+		{Type: "SRV", Name: "_sip._tcp.sub", Value: "10 5 5060 sip.example.com", TTL: time.Hour},
+		{Type: "CAA", Name: "@", Value: "0 issue letsencrypt.org", TTL: time.Hour},
+		{Type: "TXT", Name: "@", Value: `v=DKIM1; k=rsa; say "hi"`, TTL: time.Hour},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want, err := p.GetRecords(context.Background(), "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zoneFile, err := p.ExportZone(context.Background(), "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(zoneFile, "@\t86400\tIN\tSOA\tns1.linode.com. first\\.last.example.com. ") ||
+		!strings.Contains(zoneFile, " 3600 14400 1209600 86400\n") {
+		t.Errorf("got zone file\n%s\nwant the SOA record of the domain", zoneFile)
+	}
+	if n := strings.Count(zoneFile, "\tNS\tns"); n != 5 {
+		t.Errorf("got zone file\n%s\nwant the 5 NS records of Linode, got %d", zoneFile, n)
+	}
+	got, err := ParseZoneFile(strings.NewReader(zoneFile), "example.com.")
+	if err != nil {
+		t.Fatalf("parsing zone file\n%s\n%v", zoneFile, err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got records %v, want %v", got, want)
+	}
+	for i := range want {
+		if !RecordsEqual(got[i], want[i]) {
+			t.Errorf("got record %+v, want %+v", got[i], want[i])
+		}
+	}
+
+	zoneFile, err = p.ExportZone(context.Background(), "sub.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(zoneFile, "SOA") || strings.Contains(zoneFile, "\tNS\t") {
+		t.Errorf("got zone file\n%s\nwant no SOA or NS records for a subdomain zone", zoneFile)
+	}
+}
+
+func TestSRVRecordsRoundTrip(t *testing.T) {
+	p, _ := newFakeProvider("example.com")
+	records := []libdns.Record{
+		{Type: "SRV", Name: "_sip._tcp", Value: "10 5 5060 sip.example.com", TTL: time.Hour},
+		{Type: "SRV", Name: "_sip._tcp.sub", Value: "20 0 5061 sips.example.com", TTL: 2 * time.Hour},
+	}
+	added, err := p.AppendRecords(context.Background(), "example.com.", records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := p.GetRecords(context.Background(), "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != len(records) || len(got) != len(records) {
+		t.Fatalf("added %+v and got %+v, want %d records", added, got, len(records))
+	}
+	for i, record := range records {
+		if got[i] != added[i] {
+			t.Errorf("got %+v, want the added record %+v", got[i], added[i])
+		}
+		if got[i].Type != record.Type || got[i].Name != record.Name || got[i].Value != record.Value || got[i].TTL != record.TTL {
+			t.Errorf("got %+v, want %+v", got[i], record)
+		}
+	}
+
+	got, err = p.GetRecords(context.Background(), "sub.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Name != "_sip._tcp" || got[0].Value != records[1].Value {
+		t.Errorf("got %+v in the zone sub.example.com, want the record _sip._tcp.sub as _sip._tcp", got)
+	}
+}
+
+func TestPlanRecordsMatchesSetRecords(t *testing.T) {
+	p, client := newFakeProvider("example.com")
+	client.addRecord("example.com", linodego.DomainRecord{Type: "A", Name: "www", Target: "192.0.2.1", TTLSec: 3600})
+	client.addRecord("example.com", linodego.DomainRecord{Type: "A", Name: "www", Target: "192.0.2.8", TTLSec: 3600})
+	client.addRecord("example.com", linodego.DomainRecord{Type: "A", Name: "www", Target: "192.0.2.9", TTLSec: 3600})
+	client.addRecord("example.com", linodego.DomainRecord{Type: "AAAA", Name: "www", Target: "2001:db8::1", TTLSec: 3600})
+	client.addRecord("example.com", linodego.DomainRecord{Type: "TXT", Name: "", Target: "old", TTLSec: 3600})
+	client.addRecord("example.com", linodego.DomainRecord{Type: "TXT", Name: "", Target: "older", TTLSec: 3600})
+	records := []libdns.Record{
+		{Type: "A", Name: "www", Value: "192.0.2.1", TTL: time.Hour},
+		{Type: "A", Name: "www", Value: "192.0.2.2", TTL: time.Hour},
+		{Type: "TXT", Name: "@", Value: "new", TTL: time.Hour},
+		{Type: "A", Name: "api", Value: "192.0.2.3", TTL: time.Hour},
+	}
+	before, err := p.GetRecords(context.Background(), "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := p.PlanRecords(context.Background(), "example.com.", records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Apply the plan to the records before, and count the calls it takes.
+	want := append([]libdns.Record(nil), before...)
+	remove := func(id string) {
+		for i, record := range want {
+			if record.ID == id {
+				want = append(want[:i], want[i+1:]...)
+				return
+			}
+		}
+		t.Fatalf("plan %v changes the record %s, which does not exist", plan, id)
+	}
+	calls := map[string]int{}
+	for _, change := range plan {
+		switch change.Action {
+		case ChangeCreate:
+			want = append(want, change.Record)
+			calls["CreateDomainRecord"]++
+		case ChangeUpdate:
+			remove(change.Record.ID)
+			want = append(want, change.Record)
+			calls["UpdateDomainRecord"]++
+		case ChangeDelete:
+			remove(change.Record.ID)
+			calls["DeleteDomainRecord"]++
+		}
+	}
+	if calls["DeleteDomainRecord"] == 0 {
+		t.Fatalf("got plan %v, want it to delete the extraneous records", plan)
+	}
+
+	if _, err := p.SetRecords(context.Background(), "example.com.", records); err != nil {
+		t.Fatal(err)
+	}
+	for method, n := range calls {
+		if got := client.callCount(method); got != n {
+			t.Errorf("SetRecords made %d %s calls, want %d as planned by %v", got, method, n, plan)
+		}
+	}
+	got, err := p.GetRecords(context.Background(), "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got records %+v, want %+v as planned by %v", got, want, plan)
+	}
+	for _, wantRecord := range want {
+		found := false
+		for _, record := range got {
+			if RecordsEqual(record, wantRecord) && (wantRecord.ID == "" || record.ID == wantRecord.ID) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("got records %+v, want %+v among them as planned by %v", got, wantRecord, plan)
+		}
+	}
+}
+
+func TestValidateWithInjectedClient(t *testing.T) {
+	p, client := newFakeProvider("example.com")
+	if err := p.Validate(context.Background()); err != nil {
+		t.Fatalf("got error %v, want none for a client given to WithClient without a token", err)
+	}
+	if n := client.callCount("GetProfile"); n != 1 {
+		t.Errorf("got %d GetProfile calls, want 1", n)
+	}
+	if err := (&Provider{}).Validate(context.Background()); !errors.Is(err, ErrMissingToken) {
+		t.Errorf("got error %v without a token or client, want ErrMissingToken", err)
+	}
+}
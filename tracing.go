@@ -0,0 +1,69 @@
+package linode
+
+import (
+	"context"
+
+	"github.com/libdns/libdns"
+)
+
+// Tracer starts the spans traced around Linode API calls. An OpenTelemetry
+// tracer is adapted to it by wrapping trace.Tracer.Start and the
+// SetAttributes, RecordError and End methods of its spans.
+type Tracer interface {
+	// Start starts a span as a child of the span in ctx, if any, and returns
+	// a context holding the new span.
+	Start(ctx context.Context, spanName string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	SetAttribute(key string, value any)
+	RecordError(err error)
+	End()
+}
+
+type traceAttributesKey struct{}
+
+type traceAttribute struct {
+	key   string
+	value any
+}
+
+// withTraceAttributes returns ctx carrying attributes for the spans of the API
+// calls made with it, in addition to those ctx carries already. Without a
+// Tracer, ctx is returned as is.
+func (p *Provider) withTraceAttributes(ctx context.Context, attributes ...traceAttribute) context.Context {
+	if p.Tracer == nil {
+		return ctx
+	}
+	parentAttributes, _ := ctx.Value(traceAttributesKey{}).([]traceAttribute)
+	combinedAttributes := make([]traceAttribute, 0, len(parentAttributes)+len(attributes))
+	combinedAttributes = append(combinedAttributes, parentAttributes...)
+	combinedAttributes = append(combinedAttributes, attributes...)
+	return context.WithValue(ctx, traceAttributesKey{}, combinedAttributes)
+}
+
+func (p *Provider) traceZone(ctx context.Context, zone resolvedZone) context.Context {
+	if p.Tracer == nil {
+		return ctx
+	}
+	return p.withTraceAttributes(ctx, traceAttribute{"dns.zone", zone.name}, traceAttribute{"linode.domain_id", zone.domainID})
+}
+
+func (p *Provider) traceRecord(ctx context.Context, zone resolvedZone, record *libdns.Record) context.Context {
+	if p.Tracer == nil {
+		return ctx
+	}
+	return p.withTraceAttributes(p.traceZone(ctx, zone), traceAttribute{"dns.record.type", record.Type})
+}
+
+// startSpan starts the span of an API call, with the attributes ctx carries.
+func (p *Provider) startSpan(ctx context.Context, op apiOperation) (context.Context, Span) {
+	ctx, span := p.Tracer.Start(ctx, "linode."+string(op))
+	span.SetAttribute("linode.operation", string(op))
+	attributes, _ := ctx.Value(traceAttributesKey{}).([]traceAttribute)
+	for _, attribute := range attributes {
+		span.SetAttribute(attribute.key, attribute.value)
+	}
+	return ctx, span
+}
@@ -0,0 +1,400 @@
+package linode
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/linode/linodego"
+)
+
+// ImportZoneFile parses a BIND zone file for the zone and appends its records
+// to the zone like AppendRecords does, creating several of them in parallel.
+// The SOA record and the records managed by Linode are skipped. It returns the
+// records that were added.
+func (p *Provider) ImportZoneFile(ctx context.Context, zone string, r io.Reader) ([]libdns.Record, error) {
+	records, err := ParseZoneFile(r, zone)
+	if err != nil {
+		return nil, err
+	}
+	return p.AppendRecords(ctx, zone, records)
+}
+
+// ExportZone renders the records of the zone as a BIND zone file, e.g. for
+// backups or to move the zone to another DNS host. The file starts with an
+// $ORIGIN directive for the zone, and names the records relative to it. For a
+// zone that is a Linode domain of its own, it also holds the SOA record built
+// from the domain's settings and the NS records pointing to Linode's name
+// servers, so that it can be loaded as is. The serial of the SOA record is
+// the current date, as Linode does not expose the one it serves. Subdomain
+// zones are part of the zone of their Linode domain, and are rendered without
+// them.
+func (p *Provider) ExportZone(ctx context.Context, zone string) (string, error) {
+	return withZone(ctx, p, zone, func(resolved resolvedZone) (string, error) {
+		records, err := p.listDomainRecords(ctx, resolved)
+		if err != nil {
+			return "", err
+		}
+		var zoneFile strings.Builder
+		fmt.Fprintf(&zoneFile, "$ORIGIN %s.\n", resolved.name)
+		if resolved.prefix() == "" {
+			domain, err := p.getDomain(ctx, resolved.domainID)
+			if err != nil {
+				return "", err
+			}
+			writeZoneFileApex(&zoneFile, resolved, domain)
+		}
+		for _, record := range records {
+			if isManagedRecord(resolved, record) {
+				continue
+			}
+			data, err := zoneFileData(record)
+			if err != nil {
+				return "", fmt.Errorf("could not export %s record %q: %w", record.Type, record.Name, err)
+			}
+			fmt.Fprintf(&zoneFile, "%s\t%d\tIN\t%s\t%s\n", record.Name, int(record.TTL.Seconds()), record.Type, data)
+		}
+		return zoneFile.String(), nil
+	})
+}
+
+// The SOA timers Linode serves for domains that have none set.
+const (
+	defaultSOARefresh = 4 * time.Hour
+	defaultSOARetry   = 4 * time.Hour
+	defaultSOAExpire  = 14 * 24 * time.Hour
+)
+
+// writeZoneFileApex writes the SOA record of a Linode domain and the NS
+// records pointing to Linode's name servers, which Linode manages itself.
+func writeZoneFileApex(zoneFile *strings.Builder, zone resolvedZone, domain *linodego.Domain) {
+	settings := convertToZoneSettings(domain)
+	name := libdnsName("", zone)
+	ttl := int(zone.defaultTTL.Seconds())
+	fmt.Fprintf(zoneFile, "%s\t%d\tIN\tSOA\tns1.linode.com. %s %s %d %d %d %d\n",
+		name, ttl, soaMailbox(settings.SOAEmail, zone.domain), time.Now().UTC().Format("20060102")+"00",
+		int(durationOr(settings.Refresh, defaultSOARefresh).Seconds()),
+		int(durationOr(settings.Retry, defaultSOARetry).Seconds()),
+		int(durationOr(settings.Expire, defaultSOAExpire).Seconds()),
+		ttl)
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(zoneFile, "%s\t%d\tIN\tNS\tns%d.linode.com.\n", name, ttl, i)
+	}
+}
+
+// soaMailbox returns the SOA form of an email address, e.g.
+// "hostmaster.example.com." for "hostmaster@example.com", with the dots of
+// its local part escaped. Domains without an SOA email fall back to
+// hostmaster at the domain.
+func soaMailbox(email, domain string) string {
+	local, host, ok := strings.Cut(email, "@")
+	if !ok || local == "" || host == "" {
+		local, host = "hostmaster", domain
+	}
+	return strings.ReplaceAll(local, ".", `\.`) + "." + fullyQualified(host)
+}
+
+func durationOr(d, fallback time.Duration) time.Duration {
+	if d == 0 {
+		return fallback
+	}
+	return d
+}
+
+// zoneFileData returns the zone file data of a record as returned by the
+// provider, the inverse of zoneFileValue. Domain names in it are fully
+// qualified.
+func zoneFileData(record libdns.Record) (string, error) {
+	switch record.Type {
+	case "CNAME", "NS", "PTR":
+		return fullyQualified(record.Value), nil
+	case "MX":
+		priority, target, err := parseMXValue(&record)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d %s", priority, fullyQualified(target)), nil
+	case "SRV":
+		priority, weight, port, target, err := parseSRVValue(&record)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d %d %d %s", priority, weight, port, fullyQualified(target)), nil
+	case "TXT":
+		return quoteTXTStrings(record.Value), nil
+	case "CAA":
+		tag, value, err := parseCAAValue(&record)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("0 %s %s", tag, quoteTXT(value)), nil
+	}
+	return record.Value, nil
+}
+
+// fullyQualified returns name with a trailing dot.
+func fullyQualified(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+// ParseZoneFile parses the records of a BIND zone file for the zone into
+// libdns records, with names relative to the zone and values in the form the
+// provider expects, e.g. "10 mail.example.com" for MX records. Names and
+// targets are taken relative to $ORIGIN, which defaults to the zone. The SOA
+// record and the NS records at the apex pointing to Linode's name servers are
+// left out, as Linode manages them itself.
+func ParseZoneFile(r io.Reader, zone string) ([]libdns.Record, error) {
+	entries, err := readZoneFileEntries(r)
+	if err != nil {
+		return nil, err
+	}
+	zone = normalizeZone(zone)
+	// The zone is taken as a domain of its own, to name records relative
+	// to it.
+	apex := resolvedZone{name: zone, domain: zone}
+	origin := zone
+	var defaultTTL, lastTTL time.Duration
+	var owner string
+	var records []libdns.Record
+	for _, entry := range entries {
+		tokens := entry.tokens
+		switch strings.ToUpper(tokens[0]) {
+		case "$ORIGIN":
+			if len(tokens) != 2 {
+				return nil, fmt.Errorf("line %d: invalid $ORIGIN directive", entry.line)
+			}
+			origin = qualifyName(tokens[1], origin)
+			continue
+		case "$TTL":
+			if len(tokens) != 2 {
+				return nil, fmt.Errorf("line %d: invalid $TTL directive", entry.line)
+			}
+			defaultTTL, err = parseZoneFileTTL(tokens[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", entry.line, err)
+			}
+			continue
+		}
+		if strings.HasPrefix(tokens[0], "$") {
+			return nil, fmt.Errorf("line %d: unsupported directive %s", entry.line, tokens[0])
+		}
+		if !entry.inheritsOwner {
+			owner = qualifyName(tokens[0], origin)
+			tokens = tokens[1:]
+		}
+		if owner == "" {
+			return nil, fmt.Errorf("line %d: record without owner name", entry.line)
+		}
+		ttl := defaultTTL
+		if ttl == 0 {
+			ttl = lastTTL
+		}
+		for len(tokens) > 0 {
+			if recordTTL, err := parseZoneFileTTL(tokens[0]); err == nil {
+				ttl = recordTTL
+				lastTTL = recordTTL
+			} else if !isZoneFileClass(tokens[0]) {
+				break
+			}
+			tokens = tokens[1:]
+		}
+		if len(tokens) < 2 {
+			return nil, fmt.Errorf("line %d: record without type or data", entry.line)
+		}
+		recordType := strings.ToUpper(tokens[0])
+		if recordType == "SOA" {
+			continue
+		}
+		value, err := zoneFileValue(recordType, tokens[1:], origin)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", entry.line, err)
+		}
+		if isOutsideZone(owner+".", zone) {
+			return nil, fmt.Errorf("line %d: record name %s is not in the zone %s", entry.line, owner, zone)
+		}
+		record := libdns.Record{
+			Type:  recordType,
+			Name:  libdnsName(owner, apex),
+			Value: value,
+			TTL:   ttl,
+		}
+		if isManagedRecord(apex, record) {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// zoneFileValue returns the value of a record from its zone file data.
+// Domain names in the data are qualified with origin.
+func zoneFileValue(recordType string, data []string, origin string) (string, error) {
+	switch recordType {
+	case "A", "AAAA":
+		if len(data) != 1 {
+			return "", fmt.Errorf("invalid %s record data: %q", recordType, strings.Join(data, " "))
+		}
+		return data[0], nil
+	case "CNAME", "NS", "PTR":
+		if len(data) != 1 {
+			return "", fmt.Errorf("invalid %s record data: %q", recordType, strings.Join(data, " "))
+		}
+		return qualifyName(data[0], origin), nil
+	case "MX":
+		if len(data) != 2 {
+			return "", fmt.Errorf("invalid MX record data: %q", strings.Join(data, " "))
+		}
+		return data[0] + " " + qualifyName(data[1], origin), nil
+	case "SRV":
+		if len(data) != 4 {
+			return "", fmt.Errorf("invalid SRV record data: %q", strings.Join(data, " "))
+		}
+		return strings.Join(data[:3], " ") + " " + qualifyName(data[3], origin), nil
+	case "TXT", "SPF":
+		return strings.Join(data, ""), nil
+	case "CAA":
+		if len(data) != 3 {
+			return "", fmt.Errorf("invalid CAA record data: %q", strings.Join(data, " "))
+		}
+		return strings.Join(data, " "), nil
+	}
+	return "", fmt.Errorf("unsupported record type %s", recordType)
+}
+
+// qualifyName returns the fully qualified form of a zone file name, without
+// the trailing dot. Names without a trailing dot are relative to origin, and
+// "@" is origin itself.
+func qualifyName(name, origin string) string {
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return strings.TrimSuffix(name, ".")
+	case origin == "":
+		return name
+	}
+	return name + "." + origin
+}
+
+func isZoneFileClass(token string) bool {
+	switch strings.ToUpper(token) {
+	case "IN", "CH", "HS", "CS":
+		return true
+	}
+	return false
+}
+
+// zoneFileTTLUnits are the units of BIND style TTLs such as "1h30m".
+var zoneFileTTLUnits = map[byte]time.Duration{
+	's': time.Second,
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+}
+
+// parseZoneFileTTL parses a TTL in seconds, or in BIND style units.
+func parseZoneFileTTL(token string) (time.Duration, error) {
+	if seconds, err := strconv.ParseUint(token, 10, 31); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	var ttl time.Duration
+	rest := strings.ToLower(token)
+	for rest != "" {
+		i := 0
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			i++
+		}
+		if i == 0 || i == len(rest) {
+			return 0, fmt.Errorf("invalid TTL %q", token)
+		}
+		unit, ok := zoneFileTTLUnits[rest[i]]
+		if !ok {
+			return 0, fmt.Errorf("invalid TTL %q", token)
+		}
+		n, err := strconv.Atoi(rest[:i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid TTL %q: %w", token, err)
+		}
+		ttl += time.Duration(n) * unit
+		rest = rest[i+1:]
+	}
+	return ttl, nil
+}
+
+// zoneFileEntry is a directive or record of a zone file, split into tokens.
+type zoneFileEntry struct {
+	tokens []string
+	// inheritsOwner is set for records starting with whitespace, which
+	// belong to the owner name of the record before.
+	inheritsOwner bool
+	line          int
+}
+
+// readZoneFileEntries splits a zone file into its entries. Comments are
+// dropped, entries spanning several lines in parentheses are joined, and
+// quoted strings become single tokens with their escapes resolved.
+func readZoneFileEntries(r io.Reader) ([]zoneFileEntry, error) {
+	var entries []zoneFileEntry
+	var entry *zoneFileEntry
+	depth := 0
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if depth == 0 {
+			if entry != nil && len(entry.tokens) > 0 {
+				entries = append(entries, *entry)
+			}
+			entry = &zoneFileEntry{
+				inheritsOwner: strings.HasPrefix(text, " ") || strings.HasPrefix(text, "\t"),
+				line:          line,
+			}
+		}
+		for i := 0; i < len(text); {
+			switch c := text[i]; {
+			case c == ';':
+				i = len(text)
+			case c == ' ' || c == '\t':
+				i++
+			case c == '(':
+				depth++
+				i++
+			case c == ')':
+				if depth == 0 {
+					return nil, fmt.Errorf("line %d: unbalanced parentheses", line)
+				}
+				depth--
+				i++
+			case c == '"':
+				s, n, ok := unquoteTXT(text[i:])
+				if !ok {
+					return nil, fmt.Errorf("line %d: unterminated quoted string", line)
+				}
+				entry.tokens = append(entry.tokens, s)
+				i += n
+			default:
+				end := strings.IndexAny(text[i:], " \t;()\"")
+				if end < 0 {
+					end = len(text) - i
+				}
+				entry.tokens = append(entry.tokens, text[i:i+end])
+				i += end
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced parentheses at the end of the zone file")
+	}
+	if entry != nil && len(entry.tokens) > 0 {
+		entries = append(entries, *entry)
+	}
+	return entries, nil
+}